@@ -0,0 +1,284 @@
+package wsplice
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// AccessLogger records every client session and every remote connection
+// once they end. "Sent" traffic flows from the client towards remote
+// servers, "received" traffic flows back to the client.
+type AccessLogger interface {
+	LogSession(record SessionRecord)
+	LogConnection(record ConnectionRecord)
+}
+
+// SessionRecord describes a client session which ended.
+type SessionRecord struct {
+	Type             string    `json:"type"`
+	SessionID        string    `json:"sessionId"`
+	RemoteAddr       string    `json:"remoteAddr"`
+	Identity         string    `json:"identity,omitempty"`
+	TLS              *TLSInfo  `json:"tls,omitempty"`
+	StartedAt        time.Time `json:"startedAt"`
+	Duration         float64   `json:"duration"` // in milliseconds
+	SentBytes        int64     `json:"sentBytes"`
+	SentMessages     int64     `json:"sentMessages"`
+	ReceivedBytes    int64     `json:"receivedBytes"`
+	ReceivedMessages int64     `json:"receivedMessages"`
+	CloseCode        int       `json:"closeCode"`
+	CloseReason      string    `json:"closeReason"`
+}
+
+// ConnectionRecord describes a remote connection which was closed.
+type ConnectionRecord struct {
+	Type             string    `json:"type"`
+	SessionID        string    `json:"sessionId"`
+	RemoteAddr       string    `json:"remoteAddr"`
+	Identity         string    `json:"identity,omitempty"`
+	Index            int       `json:"index"`
+	URL              string    `json:"url"`
+	Target           string    `json:"target,omitempty"`
+	Topic            string    `json:"topic,omitempty"`
+	Subprotocol      string    `json:"subprotocol"`
+	OpenedAt         time.Time `json:"openedAt"`
+	Duration         float64   `json:"duration"` // in milliseconds
+	SentBytes        int64     `json:"sentBytes"`
+	SentMessages     int64     `json:"sentMessages"`
+	ReceivedBytes    int64     `json:"receivedBytes"`
+	ReceivedMessages int64     `json:"receivedMessages"`
+	CloseCode        int       `json:"closeCode"`
+	CloseReason      string    `json:"closeReason"`
+}
+
+// TLSInfo describes the TLS connection a client used.
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ServerName  string `json:"serverName,omitempty"`
+	PeerSubject string `json:"peerSubject,omitempty"`
+}
+
+// newTLSInfo describes the TLS connection state.
+func newTLSInfo(state tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tlsVersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		info.PeerSubject = state.PeerCertificates[0].Subject.String()
+	}
+
+	return info
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
+// identityFromTLS returns the common name of the client's verified
+// certificate, or an empty string if the client didn't present one.
+func identityFromTLS(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// redactedValue replaces query string values in logged URLs.
+const redactedValue = "REDACTED"
+
+// JSONAccessLog is an AccessLogger that writes each record as a line of JSON.
+type JSONAccessLog struct {
+	// RedactQuery lists query string parameters whose values are replaced
+	// in logged URLs. If it contains "*", all values are replaced.
+	RedactQuery []string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONAccessLog creates a JSONAccessLog that writes to w.
+func NewJSONAccessLog(w io.Writer) *JSONAccessLog {
+	return &JSONAccessLog{w: w}
+}
+
+// LogSession implements AccessLogger.LogSession.
+func (j *JSONAccessLog) LogSession(record SessionRecord) {
+	record.Type = "session"
+	j.write(record)
+}
+
+// LogConnection implements AccessLogger.LogConnection.
+func (j *JSONAccessLog) LogConnection(record ConnectionRecord) {
+	record.Type = "connection"
+	record.URL = j.redact(record.URL)
+	j.write(record)
+}
+
+// redact replaces the values of redacted query string parameters in the URL.
+func (j *JSONAccessLog) redact(rawURL string) string {
+	if len(j.RedactQuery) == 0 {
+		return rawURL
+	}
+
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.RawQuery == "" {
+		return rawURL
+	}
+
+	query := parsed.Query()
+	for key, values := range query {
+		if j.shouldRedact(key) {
+			for i := range values {
+				values[i] = redactedValue
+			}
+		}
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
+
+func (j *JSONAccessLog) shouldRedact(key string) bool {
+	for _, redacted := range j.RedactQuery {
+		if redacted == "*" || redacted == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write writes the record, followed by a newline, in a single call to the
+// underlying writer.
+func (j *JSONAccessLog) write(record interface{}) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	j.mu.Lock()
+	j.w.Write(append(data, '\n'))
+	j.mu.Unlock()
+}
+
+// RotatingFile is an io.WriteCloser that appends to a file, renaming it and
+// starting a new one once it would grow past MaxSize bytes. Up to MaxBackups
+// old files are kept, named like "access.log.1", "access.log.2" and so on.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// OpenRotatingFile opens or creates the file at the path for appending.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.size = stat.Size()
+	return nil
+}
+
+// Write implements io.Writer.
+func (r *RotatingFile) Write(p []byte) (n int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	if r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			// Keep writing to the current file, and try rotating it again
+			// on the next write.
+			r.file.Close()
+			if err := r.open(); err != nil {
+				r.file = nil
+				return 0, err
+			}
+		}
+	}
+
+	n, err = r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups along, dropping the oldest, and moves the
+// current file to be the first backup.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if r.MaxBackups > 0 {
+		for i := r.MaxBackups - 1; i > 0; i-- {
+			os.Rename(r.backupPath(i), r.backupPath(i+1))
+		}
+		if err := os.Rename(r.Path, r.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.Path); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) backupPath(n int) string { return fmt.Sprintf("%s.%d", r.Path, n) }
+
+// Close implements io.Closer.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,109 @@
+package wsplice
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONAccessLogWritesLines(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := NewJSONAccessLog(buf)
+	log.LogSession(SessionRecord{SessionID: "a", CloseCode: 1000})
+	log.LogConnection(ConnectionRecord{SessionID: "a", URL: "ws://example.com/"})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var session SessionRecord
+	require.Nil(t, json.Unmarshal(lines[0], &session))
+	require.Equal(t, "session", session.Type)
+	require.Equal(t, 1000, session.CloseCode)
+
+	var connection ConnectionRecord
+	require.Nil(t, json.Unmarshal(lines[1], &connection))
+	require.Equal(t, "connection", connection.Type)
+	require.Equal(t, "ws://example.com/", connection.URL)
+}
+
+func TestJSONAccessLogRedactsQueryStrings(t *testing.T) {
+	tt := []struct {
+		redact   []string
+		url      string
+		expected string
+	}{
+		{nil, "ws://example.com/?token=secret", "ws://example.com/?token=secret"},
+		{[]string{"token"}, "ws://example.com/?token=secret&room=5", "ws://example.com/?room=5&token=REDACTED"},
+		{[]string{"*"}, "ws://example.com/?token=secret&room=5", "ws://example.com/?room=REDACTED&token=REDACTED"},
+		{[]string{"token"}, "ws://example.com/", "ws://example.com/"},
+	}
+
+	for _, test := range tt {
+		log := NewJSONAccessLog(ioutil.Discard)
+		log.RedactQuery = test.redact
+		require.Equal(t, test.expected, log.redact(test.url))
+	}
+}
+
+func TestRotatingFileRotates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	require.Nil(t, err)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		require.Nil(t, err)
+	}
+
+	expected := map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	}
+	for name, contents := range expected {
+		actual, err := ioutil.ReadFile(name)
+		require.Nil(t, err)
+		require.Equal(t, contents, string(actual))
+	}
+
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestRotatingFileKeepsWritingWhenRotationFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// A backup path which can't be replaced makes rotation fail.
+	path := filepath.Join(dir, "access.log")
+	require.Nil(t, os.MkdirAll(filepath.Join(path+".1", "taken"), 0755))
+	file, err := OpenRotatingFile(path, 10, 1)
+	require.Nil(t, err)
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n"} {
+		_, err := file.Write([]byte(line))
+		require.Nil(t, err)
+	}
+	actual, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "first\nsecond\n", string(actual))
+
+	require.Nil(t, os.RemoveAll(path+".1"))
+	_, err = file.Write([]byte("third\n"))
+	require.Nil(t, err)
+	actual, err = ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, "third\n", string(actual))
+}
@@ -0,0 +1,219 @@
+package wsplice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// A Message is published to a topic by one of its subscribers.
+type Message struct {
+	// Sender identifies the subscription which published the message, so
+	// that it isn't delivered back to it.
+	Sender  string
+	OpCode  ws.OpCode
+	Payload []byte
+}
+
+// A Broker delivers messages published to topics to their subscribers.
+// MemoryBroker is a Broker for a single wsplice process; other
+// implementations could relay messages between several.
+type Broker interface {
+	// Subscribe calls deliver with every message published to the topic
+	// until unsubscribe is called.
+	Subscribe(topic string, deliver func(Message)) (unsubscribe func(), err error)
+	// Publish delivers the message to the topic's subscribers.
+	Publish(topic string, msg Message) error
+}
+
+// memoryBrokerQueueSize is how many messages the MemoryBroker holds for each
+// subscriber which is still handling earlier ones.
+const memoryBrokerQueueSize = 256
+
+// MemoryBroker is a Broker which delivers messages to subscribers in the same
+// process. Each subscriber gets its messages in order on a goroutine of its
+// own, so publishers don't wait on slow subscribers; messages which arrive
+// while a subscriber's queue is full are dropped for it.
+type MemoryBroker struct {
+	mu     sync.Mutex
+	topics map[string]map[*memorySubscriber]bool
+}
+
+type memorySubscriber struct{ queue chan Message }
+
+// NewMemoryBroker creates an empty MemoryBroker.
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{topics: map[string]map[*memorySubscriber]bool{}}
+}
+
+// Subscribe implements Broker.Subscribe.
+func (b *MemoryBroker) Subscribe(topic string, deliver func(Message)) (func(), error) {
+	sub := &memorySubscriber{make(chan Message, memoryBrokerQueueSize)}
+	go func() {
+		for msg := range sub.queue {
+			deliver(msg)
+		}
+	}()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = map[*memorySubscriber]bool{}
+	}
+	b.topics[topic][sub] = true
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if !b.topics[topic][sub] {
+			return
+		}
+		delete(b.topics[topic], sub)
+		close(sub.queue)
+		if len(b.topics[topic]) == 0 {
+			delete(b.topics, topic)
+		}
+	}, nil
+}
+
+// Publish implements Broker.Publish.
+func (b *MemoryBroker) Publish(topic string, msg Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.topics[topic] {
+		select {
+		case sub.queue <- msg:
+		default:
+		}
+	}
+	return nil
+}
+
+// A TopicRule lets clients with matching identities use matching topics.
+type TopicRule struct {
+	// Identity is matched against the common name of clients' certificates,
+	// where "*" matches any part of it, or any client at all on its own. An
+	// empty Identity only matches clients without certificates.
+	Identity string
+	// Topics are the topics the rule covers, where "*" matches any part of
+	// them.
+	Topics []string
+	// ReadOnly clients may subscribe to the topics but not publish to them.
+	ReadOnly bool
+}
+
+// topicAccess returns whether the client with the identity may subscribe to
+// the topic, and whether it may publish to it. The first of the TopicRules
+// to match decides; without any rules, no client may use any topic.
+func (c *Config) topicAccess(identity, topic string) (subscribe, publish bool) {
+	for _, rule := range c.TopicRules {
+		if matched, _ := path.Match(rule.Identity, identity); !matched {
+			continue
+		}
+		for _, pattern := range rule.Topics {
+			if matched, _ := path.Match(pattern, topic); matched {
+				return true, !rule.ReadOnly
+			}
+		}
+	}
+
+	return false, false
+}
+
+// subscribe handles the "subscribe" method, creating a connection which
+// sends the client the messages published to the topic, and publishes the
+// messages the client sends to it.
+func (s *Session) subscribe(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var parsed SubscribeCommand
+	if err := json.Unmarshal(params, &parsed); err != nil || parsed.Topic == "" {
+		return nil, BadJSON
+	}
+	canSubscribe, canPublish := s.dialConfig().topicAccess(s.identity, parsed.Topic)
+	if !canSubscribe {
+		return nil, TopicForbidden.WithPath("topic")
+	}
+
+	cnx := newConnection(ctx, s, ConnectCommand{IdleTimeout: parsed.IdleTimeout, Sequenced: parsed.Sequenced})
+	cnx.topic = parsed.Topic
+	cnx.canPublish = canPublish
+	cnx.span.SetAttributes(attribute.String("wsplice.topic", parsed.Topic))
+	index, err := s.insertConnection(cnx, parsed.Index)
+	if err != nil {
+		endSpan(cnx.span, err)
+		return nil, err
+	}
+
+	unsubscribe, err := s.server.Broker.Subscribe(parsed.Topic, cnx.deliver)
+	if err != nil {
+		s.removeConnection(cnx)
+		endSpan(cnx.span, err)
+		return nil, &ResponseError{Code: DialError, Message: err.Error(), Path: "topic"}
+	}
+	cnx.openTopic(unsubscribe)
+	cnx.startIdleTimer()
+
+	return SubscribeResponse{index}, nil
+}
+
+// openTopic opens a connection to a topic once it's been subscribed to,
+// unsubscribing again if the connection was closed in the meantime.
+func (c *Connection) openTopic(unsubscribe func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.State() != StateConnecting {
+		unsubscribe()
+		return
+	}
+
+	c.unsubscribe = unsubscribe
+	c.setState(StateOpen)
+	c.span.AddEvent("open")
+}
+
+// sender identifies the connection as the sender of the messages it
+// publishes.
+func (c *Connection) sender() string {
+	return c.session.id + "/" + strconv.Itoa(c.index)
+}
+
+// deliver sends a message published to the connection's topic to the
+// client, unless the connection published it.
+func (c *Connection) deliver(msg Message) {
+	if c.State() != StateOpen || msg.Sender == c.sender() {
+		return
+	}
+
+	header := ws.Header{Fin: true, OpCode: msg.OpCode, Length: int64(len(msg.Payload))}
+	c.stats.countReceived(header.Length)
+	c.receive(header, bytes.NewReader(msg.Payload))
+}
+
+// publish publishes a frame the client sent to the connection's topic. The
+// frames of fragmented messages are collected until the last one arrives,
+// so that subscribers only get whole messages.
+func (c *Connection) publish(header ws.Header, frame io.Reader) error {
+	if !c.canPublish {
+		return TopicReadOnly
+	}
+	if c.State() != StateOpen {
+		return UnknownConnection
+	}
+
+	opCode, payload, complete, err := c.sent.add(header, frame, c.config.FrameSizeLimit)
+	if err != nil || !complete {
+		return err
+	}
+	c.stats.countSent(int64(len(payload)), true)
+
+	msg := Message{Sender: c.sender(), OpCode: opCode, Payload: payload}
+	return c.session.server.Broker.Publish(c.topic, msg)
+}
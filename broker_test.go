@@ -0,0 +1,159 @@
+package wsplice
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBrokerDelivers(t *testing.T) {
+	broker := NewMemoryBroker()
+	got := make(chan Message, 2)
+	unsubscribe, err := broker.Subscribe("chat", func(msg Message) { got <- msg })
+	require.Nil(t, err)
+	_, err = broker.Subscribe("other", func(msg Message) { t.Fatal("delivered to the wrong topic") })
+	require.Nil(t, err)
+
+	msg := Message{Sender: "a", OpCode: ws.OpText, Payload: []byte("hi")}
+	require.Nil(t, broker.Publish("chat", msg))
+	require.Equal(t, msg, <-got)
+
+	unsubscribe()
+	require.Nil(t, broker.Publish("chat", msg))
+	require.Len(t, got, 0)
+	require.NotContains(t, broker.topics, "chat")
+}
+
+func TestMemoryBrokerDoesNotWaitForSlowSubscribers(t *testing.T) {
+	broker := NewMemoryBroker()
+	stuck := make(chan struct{})
+	defer close(stuck)
+	_, err := broker.Subscribe("chat", func(Message) { <-stuck })
+	require.Nil(t, err)
+	got := make(chan Message, memoryBrokerQueueSize*2)
+	_, err = broker.Subscribe("chat", func(msg Message) { got <- msg })
+	require.Nil(t, err)
+
+	// Publishing carries on once the stuck subscriber's queue is full.
+	for i := 0; i < memoryBrokerQueueSize*2; i++ {
+		require.Nil(t, broker.Publish("chat", Message{OpCode: ws.OpText, Payload: []byte("hi")}))
+	}
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		require.Fail(t, "expected the other subscriber to get the message")
+	}
+}
+
+func TestTopicAccess(t *testing.T) {
+	config := &Config{}
+	subscribe, publish := config.topicAccess("", "anything")
+	assert.False(t, subscribe)
+	assert.False(t, publish)
+
+	config.TopicRules = []TopicRule{
+		{Identity: "admin.example.com", Topics: []string{"*"}},
+		{Identity: "*.example.com", Topics: []string{"rooms/*"}},
+		{Identity: "*", Topics: []string{"announcements"}, ReadOnly: true},
+	}
+	tt := []struct {
+		identity, topic    string
+		subscribe, publish bool
+	}{
+		{"admin.example.com", "announcements", true, true},
+		{"bot.example.com", "rooms/5", true, true},
+		{"bot.example.com", "announcements", true, false},
+		{"", "announcements", true, false},
+		{"", "rooms/5", false, false},
+		{"bot.example.com", "secrets", false, false},
+	}
+	for _, test := range tt {
+		subscribe, publish := config.topicAccess(test.identity, test.topic)
+		assert.Equal(t, test.subscribe, subscribe, "%s subscribing to %s", test.identity, test.topic)
+		assert.Equal(t, test.publish, publish, "%s publishing to %s", test.identity, test.topic)
+	}
+}
+
+func (e *EndToEndSuite) TestPublishesToTopics() {
+	e.server.Broker = NewMemoryBroker()
+	e.config.TopicRules = []TopicRule{{Identity: "*", Topics: []string{"*"}}}
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	e.write(a, 0xffff, `{"id":1,"type":"method","method":"subscribe","params":{"topic":"chat"}}`)
+	e.expectRead(a, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(b, 0xffff, `{"id":1,"type":"method","method":"subscribe","params":{"topic":"chat","index":2}}`)
+	e.expectRead(b, 0xffff, `{"id":1,"type":"reply","result":{"index":2}}`)
+
+	e.write(a, 0, `"hello"`)
+	e.expectRead(b, 2, `"hello"`)
+	e.write(b, 2, `"hi"`)
+	e.expectRead(a, 0, `"hi"`)
+
+	e.write(a, 0xffff, `{"id":2,"type":"method","method":"listConnections"}`)
+	var reply struct {
+		Result ListConnectionsResponse `json:"result"`
+	}
+	e.readJSON(a, 0xffff, &reply)
+	require.Len(e.T(), reply.Result.Connections, 1)
+	require.Equal(e.T(), "chat", reply.Result.Connections[0].Topic)
+	require.Equal(e.T(), int64(1), reply.Result.Connections[0].SentMessages)
+	require.Equal(e.T(), int64(1), reply.Result.Connections[0].ReceivedMessages)
+
+	// Once unsubscribed, a's messages are no longer delivered to it.
+	e.write(a, 0xffff, `{"id":3,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectRead(a, 0xffff, `{"id":3,"type":"reply","result":{}}`)
+	e.write(b, 2, `"anyone?"`)
+	e.write(b, 0xffff, `{"id":2,"type":"method","method":"listConnections"}`)
+	e.readJSON(b, 0xffff, &reply)
+	e.write(a, 0xffff, `{"id":4,"type":"method","method":"subscribe","params":{"topic":"chat"}}`)
+	e.expectRead(a, 0xffff, `{"id":4,"type":"reply","result":{"index":0}}`)
+	e.write(b, 2, `"welcome back"`)
+	e.expectRead(a, 0, `"welcome back"`)
+}
+
+func (e *EndToEndSuite) TestPublishesFragmentedMessages() {
+	e.server.Broker = NewMemoryBroker()
+	e.config.TopicRules = []TopicRule{{Identity: "*", Topics: []string{"*"}}}
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"subscribe","params":{"topic":"chat"}}`)
+		e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	}
+
+	// Gorilla fragments messages at 64kb, so this is split up.
+	message := `"` + strings.Repeat("a", 200*1024) + `"`
+	e.write(a, 0, message)
+	e.expectRead(b, 0, message)
+}
+
+func (e *EndToEndSuite) TestChecksTopicRules() {
+	e.server.Broker = NewMemoryBroker()
+	e.config.TopicRules = []TopicRule{{Identity: "*", Topics: []string{"news"}, ReadOnly: true}}
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"subscribe","params":{"topic":"secrets"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","error":{"code":4016,"message":"You may not subscribe to that topic","path":"topic"}}`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"subscribe","params":{"topic":"news"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"fake news"`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4017,`+
+		`"message":"You may not publish to that topic"}}`)
+}
+
+func (e *EndToEndSuite) TestRequiresBrokerForTopics() {
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"subscribe","params":{"topic":"chat"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","error":{"code":4003,"message":"Unknown method name"}}`)
+}
@@ -15,10 +15,10 @@ import (
 
 	"io"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 	"github.com/mixer/wsplice"
+	"github.com/sirupsen/logrus"
 )
 
 var (
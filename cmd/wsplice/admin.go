@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/ws"
+	"github.com/mixer/wsplice"
+	"github.com/sirupsen/logrus"
+)
+
+// adminAPI is an HTTP API that lets operators inspect and close sessions.
+// Every request must carry the token in an "Authorization: Bearer" header.
+//
+//	GET    /sessions                           lists all sessions
+//	GET    /sessions/{id}                      shows a session and its connections
+//	DELETE /sessions/{id}?code=&reason=        closes a session
+//	DELETE /sessions/{id}/{index}?code=&reason= closes one of its connections
+//	POST   /notices                            sends {"message": "..."} to all sessions
+type adminAPI struct {
+	servers []*wsplice.Server
+	token   string
+}
+
+// sessionDetails is the response to showing a single session.
+type sessionDetails struct {
+	wsplice.SessionInfo
+	ConnectionList []wsplice.ConnectionInfo `json:"connectionList"`
+}
+
+// noticeRequest is the body to POST to /notices.
+type noticeRequest struct {
+	Message string `json:"message"`
+}
+
+func (a *adminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wsplice"`)
+		writeAdminError(w, http.StatusUnauthorized, "invalid or missing admin token")
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(path) == 1 && path[0] == "sessions" && r.Method == http.MethodGet:
+		a.listSessions(w)
+	case len(path) == 2 && path[0] == "sessions" && r.Method == http.MethodGet:
+		a.showSession(w, path[1])
+	case len(path) == 2 && path[0] == "sessions" && r.Method == http.MethodDelete:
+		a.closeSession(w, r, path[1])
+	case len(path) == 3 && path[0] == "sessions" && r.Method == http.MethodDelete:
+		a.closeConnection(w, r, path[1], path[2])
+	case len(path) == 1 && path[0] == "notices" && r.Method == http.MethodPost:
+		a.broadcastNotice(w, r)
+	default:
+		writeAdminError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *adminAPI) authorized(r *http.Request) bool {
+	token := bearerToken(r)
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// session returns the session with the ID from any of the servers, or nil.
+func (a *adminAPI) session(id string) *wsplice.Session {
+	for _, server := range a.servers {
+		if session := server.Session(id); session != nil {
+			return session
+		}
+	}
+
+	return nil
+}
+
+func (a *adminAPI) listSessions(w http.ResponseWriter) {
+	infos := []wsplice.SessionInfo{}
+	for _, server := range a.servers {
+		for _, session := range server.Sessions() {
+			infos = append(infos, session.Info())
+		}
+	}
+
+	writeAdminJSON(w, http.StatusOK, infos)
+}
+
+func (a *adminAPI) showSession(w http.ResponseWriter, id string) {
+	session := a.session(id)
+	if session == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, sessionDetails{
+		SessionInfo:    session.Info(),
+		ConnectionList: session.ListConnections(),
+	})
+}
+
+func (a *adminAPI) closeSession(w http.ResponseWriter, r *http.Request, id string) {
+	session := a.session(id)
+	if session == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	code, reason, ok := closeStatus(w, r)
+	if !ok {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{"id": id, "code": code, "reason": reason}).Info("Closing session from admin API")
+	session.CloseWithReason(code, reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) closeConnection(w http.ResponseWriter, r *http.Request, id, rawIndex string) {
+	session := a.session(id)
+	if session == nil {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "index must be a number")
+		return
+	}
+
+	code, reason, ok := closeStatus(w, r)
+	if !ok {
+		return
+	}
+
+	if !session.CloseConnection(index, code, reason) {
+		writeAdminError(w, http.StatusNotFound, "connection not found")
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{"id": id, "index": index, "code": code, "reason": reason}).
+		Info("Closed connection from admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminAPI) broadcastNotice(w http.ResponseWriter, r *http.Request) {
+	var body noticeRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Message == "" {
+		writeAdminError(w, http.StatusBadRequest, `expected a JSON body like {"message": "..."}`)
+		return
+	}
+
+	var count int
+	for _, server := range a.servers {
+		count += server.BroadcastNotice(body.Message)
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]int{"sessions": count})
+}
+
+// maxCloseReasonSize is the longest reason which fits in a close frame,
+// whose payload is at most 125 bytes including the two byte code.
+const maxCloseReasonSize = 123
+
+// closeStatus reads the close code and reason from the query string. The code
+// defaults to a normal closure. It writes an error and returns false if the
+// code can't be sent in a close frame or the reason is too long.
+func closeStatus(w http.ResponseWriter, r *http.Request) (ws.StatusCode, string, bool) {
+	code := ws.StatusNormalClosure
+	if raw := r.URL.Query().Get("code"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || !sendableCloseCode(parsed) {
+			writeAdminError(w, http.StatusBadRequest, "code must be a websocket close code")
+			return 0, "", false
+		}
+		code = ws.StatusCode(parsed)
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if len(reason) > maxCloseReasonSize {
+		writeAdminError(w, http.StatusBadRequest, "reason must be at most 123 bytes")
+		return 0, "", false
+	}
+
+	return code, reason, true
+}
+
+// sendableCloseCode returns whether the code may be sent in a close frame:
+// one of those RFC 6455 defines for endpoints to send, or one reserved for
+// libraries or applications. 1004, 1005, 1006 and 1015 are only for local
+// use, and the rest below 3000 are unassigned.
+func sendableCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+// startAdmin serves the admin API for the servers, if an address was given.
+func startAdmin(servers []*wsplice.Server) {
+	if *adminAddress == "" {
+		return
+	}
+	if *adminToken == "" {
+		logrus.Fatal("An --admin-token is required to run the admin API")
+	}
+
+	handler := &adminAPI{servers: servers, token: *adminToken}
+	if err := http.ListenAndServe(*adminAddress, handler); err != nil {
+		logrus.WithError(err).Fatal("Error starting admin server")
+	}
+}
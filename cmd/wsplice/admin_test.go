@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mixer/wsplice"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	api := &adminAPI{servers: []*wsplice.Server{{Config: &wsplice.Config{}}}, token: "secret"}
+
+	tt := []struct {
+		method, path, token, body string
+		status                    int
+		response                  string
+	}{
+		{"GET", "/sessions", "", "", http.StatusUnauthorized, `{"error":"invalid or missing admin token"}`},
+		{"GET", "/sessions", "wrong", "", http.StatusUnauthorized, `{"error":"invalid or missing admin token"}`},
+		{"GET", "/sessions", "secret", "", http.StatusOK, `[]`},
+		{"GET", "/sessions/nope", "secret", "", http.StatusNotFound, `{"error":"session not found"}`},
+		{"DELETE", "/sessions/nope/0", "secret", "", http.StatusNotFound, `{"error":"session not found"}`},
+		{"POST", "/notices", "secret", `{}`, http.StatusBadRequest, `{"error":"expected a JSON body like {\"message\": \"...\"}"}`},
+		{"POST", "/notices", "secret", `{"message":"hi"}`, http.StatusOK, `{"sessions":0}`},
+		{"PUT", "/sessions", "secret", "", http.StatusNotFound, `{"error":"not found"}`},
+	}
+
+	for _, test := range tt {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+
+		require.Equal(t, test.status, rec.Code, "%s %s", test.method, test.path)
+		require.JSONEq(t, test.response, rec.Body.String(), "%s %s", test.method, test.path)
+	}
+}
+
+func TestValidatesCloseStatuses(t *testing.T) {
+	tt := []struct {
+		query string
+		ok    bool
+	}{
+		{"", true},
+		{"code=1001&reason=restarting", true},
+		{"code=1011", true},
+		{"code=4000", true},
+		{"code=999", false},
+		{"code=1004", false},
+		{"code=1005", false},
+		{"code=1006", false},
+		{"code=1015", false},
+		{"code=2000", false},
+		{"code=5000", false},
+		{"code=close", false},
+		{"reason=" + strings.Repeat("a", 123), true},
+		{"reason=" + strings.Repeat("a", 124), false},
+	}
+
+	for _, test := range tt {
+		rec := httptest.NewRecorder()
+		_, _, ok := closeStatus(rec, httptest.NewRequest("DELETE", "/sessions/id?"+test.query, nil))
+		require.Equal(t, test.ok, ok, test.query)
+		if !ok {
+			require.Equal(t, http.StatusBadRequest, rec.Code, test.query)
+		}
+	}
+}
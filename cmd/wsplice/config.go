@@ -0,0 +1,759 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/alecthomas/units"
+	"github.com/mixer/wsplice"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// configPollInterval is how often the config file is checked for changes.
+	configPollInterval = 5 * time.Second
+	// defaultHealthPath is where listeners serve health checks unless the
+	// config file says otherwise.
+	defaultHealthPath = "/healthz"
+	// defaultReadyPath is where listeners serve readiness checks unless the
+	// config file says otherwise.
+	defaultReadyPath = "/readyz"
+)
+
+// serverFile holds the settings in the config file which make up a
+// wsplice.Config. Its keys are named after the command line flags and, like
+// them, durations and sizes are strings such as "30s" and "5MB". Keys which
+// are left out keep their flag's value.
+type serverFile struct {
+	FrameSizeLimit     *string  `yaml:"frame-size-limit" toml:"frame-size-limit"`
+	WriteTimeout       *string  `yaml:"write-timeout" toml:"write-timeout"`
+	ReadTimeout        *string  `yaml:"read-timeout" toml:"read-timeout"`
+	DialTimeout        *string  `yaml:"dial-timeout" toml:"dial-timeout"`
+	PingInterval       *string  `yaml:"ping-interval" toml:"ping-interval"`
+	ClientPingInterval *string  `yaml:"client-ping-interval" toml:"client-ping-interval"`
+	AllowedHostnames   []string `yaml:"allowed-hostnames" toml:"allowed-hostnames"`
+	ForwardableHeaders []string `yaml:"forwardable-headers" toml:"forwardable-headers"`
+	ConnectQueueLimit  *int     `yaml:"connect-queue-limit" toml:"connect-queue-limit"`
+	ConnectQueueBytes  *string  `yaml:"connect-queue-bytes" toml:"connect-queue-bytes"`
+	RetransmitLimit    *int     `yaml:"retransmit-limit" toml:"retransmit-limit"`
+	RetransmitBytes    *string  `yaml:"retransmit-bytes" toml:"retransmit-bytes"`
+	MonotonicIndices   *bool    `yaml:"monotonic-indices" toml:"monotonic-indices"`
+	IndexQuarantine    *string  `yaml:"index-quarantine" toml:"index-quarantine"`
+	IdleTimeout        *string  `yaml:"idle-timeout" toml:"idle-timeout"`
+	MaxIdleTimeout     *string  `yaml:"max-idle-timeout" toml:"max-idle-timeout"`
+	SessionIdleTimeout *string  `yaml:"session-idle-timeout" toml:"session-idle-timeout"`
+
+	// Targets are the upstreams clients may connect to by name. They can
+	// only be given in the config file.
+	Targets       map[string]targetFile `yaml:"targets" toml:"targets"`
+	ForbidRawURLs *bool                 `yaml:"forbid-raw-urls" toml:"forbid-raw-urls"`
+
+	SharedWrites *bool `yaml:"shared-writes" toml:"shared-writes"`
+
+	// TopicRules decide who may use which topics. They can only be given
+	// in the config file.
+	TopicRules []topicRuleFile `yaml:"topic-rules" toml:"topic-rules"`
+}
+
+// topicRuleFile describes a wsplice.TopicRule.
+type topicRuleFile struct {
+	Identity string   `yaml:"identity" toml:"identity"`
+	Topics   []string `yaml:"topics" toml:"topics"`
+	ReadOnly bool     `yaml:"read-only" toml:"read-only"`
+}
+
+// targetFile describes a named upstream. Its TLS CA is used to verify the
+// upstream's certificate, and its certificate and key are presented to it.
+type targetFile struct {
+	tlsFile `yaml:",inline"`
+
+	URL         string            `yaml:"url" toml:"url"`
+	Headers     map[string]string `yaml:"headers" toml:"headers"`
+	DialTimeout *string           `yaml:"dial-timeout" toml:"dial-timeout"`
+
+	// Backends are a pool of URLs to use instead of the URL.
+	Backends            []string `yaml:"backends" toml:"backends"`
+	Balancer            string   `yaml:"balancer" toml:"balancer"`
+	MaxFailures         int      `yaml:"max-failures" toml:"max-failures"`
+	EjectionTime        *string  `yaml:"ejection-time" toml:"ejection-time"`
+	HealthCheckInterval *string  `yaml:"health-check-interval" toml:"health-check-interval"`
+
+	// Schema is the path of a JSON Schema file for messages sent to it.
+	Schema *string `yaml:"schema" toml:"schema"`
+}
+
+// tlsFile holds the TLS paths for a listener.
+type tlsFile struct {
+	TLSCert *string `yaml:"tls-cert" toml:"tls-cert"`
+	TLSKey  *string `yaml:"tls-key" toml:"tls-key"`
+	TLSCA   *string `yaml:"tls-ca" toml:"tls-ca"`
+}
+
+// configFile is the layout of the file given with --config, in YAML or TOML.
+// The top-level settings apply to every route. If no listeners are given,
+// wsplice listens as told by the flags and serves every path with the
+// top-level settings.
+type configFile struct {
+	serverFile `yaml:",inline"`
+	tlsFile    `yaml:",inline"`
+
+	RequireClientCert *bool `yaml:"tls-require-client-cert" toml:"tls-require-client-cert"`
+
+	Listeners []listenerFile `yaml:"listeners" toml:"listeners"`
+}
+
+// listenerFile describes one of the addresses wsplice listens on.
+type listenerFile struct {
+	tlsFile `yaml:",inline"`
+
+	Listen  string `yaml:"listen" toml:"listen"`
+	Network string `yaml:"network" toml:"network"`
+	// Framing is "websocket", the default, or "raw" for clients which send
+	// length-prefixed messages over plain TCP or Unix sockets. Raw
+	// listeners have a single route, whose path is ignored.
+	Framing string `yaml:"framing" toml:"framing"`
+	// RequireClientCert rejects clients which don't present a certificate
+	// signed by the TLS CA. Otherwise they're only verified if they do.
+	RequireClientCert bool `yaml:"tls-require-client-cert" toml:"tls-require-client-cert"`
+	// HealthPath is where health checks are served, "/healthz" by default.
+	// It can be set to an empty string to turn them off.
+	HealthPath *string `yaml:"health-path" toml:"health-path"`
+	// ReadyPath is where readiness checks are served, "/readyz" by default.
+	// It can be set to an empty string to turn them off.
+	ReadyPath *string     `yaml:"ready-path" toml:"ready-path"`
+	Routes    []routeFile `yaml:"routes" toml:"routes"`
+}
+
+// routeFile describes an HTTP path on a listener, which has its own Server.
+// Its settings override the top-level ones, but not flags given on the
+// command line, which override both.
+type routeFile struct {
+	serverFile `yaml:",inline"`
+
+	Path string `yaml:"path" toml:"path"`
+	// AuthTokens, if given, are the bearer tokens one of which clients must
+	// provide in their Authorization header.
+	AuthTokens []string `yaml:"auth-tokens" toml:"auth-tokens"`
+	// AllowedIdentities, if given, are the common names of the client
+	// certificates which may use the route.
+	AllowedIdentities []string `yaml:"allowed-identities" toml:"allowed-identities"`
+}
+
+// settings is the configuration from the flags and the config file.
+type settings struct {
+	config    *wsplice.Config
+	listeners []listenerSettings
+	targets   targetCache
+}
+
+// targetCache maps target definitions, as returned by targetFile.definition,
+// to the Upstream loaded for them.
+type targetCache map[string]*wsplice.Upstream
+
+// listenerSettings describes an address to listen on.
+type listenerSettings struct {
+	listen     string
+	network    string
+	raw        bool
+	tlsCert    string
+	tlsKey     string
+	tlsCA      string
+	healthPath string
+	readyPath  string
+	routes     []routeSettings
+
+	// requireClientCert rejects clients without a certificate signed by
+	// the tlsCA.
+	requireClientCert bool
+}
+
+// routeSettings describes an HTTP path and the Server that handles it.
+type routeSettings struct {
+	path              string
+	config            *wsplice.Config
+	authTokens        []string
+	allowedIdentities []string
+}
+
+// flagConfig returns the server config given by the command line flags.
+func flagConfig() *wsplice.Config {
+	return &wsplice.Config{
+		FrameSizeLimit:     int64(*frameSizeLimit),
+		WriteTimeout:       *writeTimeout,
+		ReadTimeout:        *readTimeout,
+		DialTimeout:        *dialTimeout,
+		PingInterval:       *pingInterval,
+		ClientPingInterval: *clientPingInterval,
+		HostnameAllowlist:  *allowedHostnames,
+		ForwardableHeaders: *forwardableHeaders,
+		ConnectQueueLimit:  *connectQueueLimit,
+		ConnectQueueBytes:  int64(*connectQueueBytes),
+		RetransmitLimit:    *retransmitLimit,
+		RetransmitBytes:    int64(*retransmitBytes),
+		MonotonicIndices:   *monotonicIndices,
+		ForbidRawURLs:      *forbidRawURLs,
+		SharedWrites:       *sharedWrites,
+		IndexQuarantine:    *indexQuarantine,
+		IdleTimeout:        *idleTimeout,
+		MaxIdleTimeout:     *maxIdleTimeout,
+		SessionIdleTimeout: *sessionIdleTimeout,
+	}
+}
+
+// listenerFlags are the flags describing the listener wsplice uses when the
+// config file doesn't list any.
+var listenerFlags = []string{"listen", "network", "tls-cert", "tls-key", "tls-ca", "tls-require-client-cert"}
+
+// explicitFlags returns the names of the flags given on the command line,
+// which take precedence over the config file.
+func explicitFlags(app *kingpin.Application, args []string) (map[string]bool, error) {
+	context, err := app.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+
+	explicit := map[string]bool{}
+	for _, element := range context.Elements {
+		if flag, ok := element.Clause.(*kingpin.FlagClause); ok {
+			explicit[flag.Model().Name] = true
+		}
+	}
+
+	return explicit, nil
+}
+
+// loadSettings reads the config file, if any, over the flag settings.
+// Targets whose definition is in the previous cache keep their Upstream.
+func loadSettings(path string, explicit map[string]bool, previous targetCache) (settings, error) {
+	s := settings{config: flagConfig(), targets: targetCache{}}
+	listener := listenerSettings{
+		listen:     *host,
+		network:    *network,
+		tlsCert:    *certFile,
+		tlsKey:     *keyFile,
+		tlsCA:      *caFile,
+		healthPath: defaultHealthPath,
+		readyPath:  defaultReadyPath,
+
+		requireClientCert: *requireClientCert,
+	}
+
+	var file *configFile
+	if path != "" {
+		var err error
+		if file, err = readConfigFile(path); err != nil {
+			return s, err
+		}
+		if err := file.serverFile.apply(s.config, explicit, s.targets.reusing(previous)); err != nil {
+			return s, err
+		}
+		file.tlsFile.apply(&listener, explicit)
+		if file.RequireClientCert != nil && !explicit["tls-require-client-cert"] {
+			listener.requireClientCert = *file.RequireClientCert
+		}
+	}
+
+	if file == nil || len(file.Listeners) == 0 {
+		listener.routes = []routeSettings{{path: "/", config: s.config}}
+		s.listeners = []listenerSettings{listener}
+		return s, nil
+	}
+
+	// The listeners in the file replace the one the flags describe, so
+	// its flags can't be given alongside them.
+	for _, name := range listenerFlags {
+		if explicit[name] {
+			return s, fmt.Errorf("the --%s flag can't be used with listeners in the config file", name)
+		}
+	}
+	for i, l := range file.Listeners {
+		listener, err := l.settings(s.config, explicit, s.targets.reusing(previous))
+		if err != nil {
+			return s, fmt.Errorf("invalid listener %d: %s", i, err)
+		}
+		s.listeners = append(s.listeners, listener)
+	}
+
+	return s, nil
+}
+
+// readConfigFile parses the config file as TOML if it has a ".toml"
+// extension, or as YAML otherwise.
+func readConfigFile(path string) (*configFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := &configFile{}
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(data, file)
+	} else {
+		err = yaml.Unmarshal(data, file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+
+	return file, nil
+}
+
+// apply copies the values in the file to the config, except those which
+// were explicitly given as flags. Targets are loaded through the lookup.
+func (f *serverFile) apply(config *wsplice.Config, explicit map[string]bool, lookup targetLookup) error {
+	durations := []struct {
+		name   string
+		value  *string
+		target *time.Duration
+	}{
+		{"write-timeout", f.WriteTimeout, &config.WriteTimeout},
+		{"read-timeout", f.ReadTimeout, &config.ReadTimeout},
+		{"dial-timeout", f.DialTimeout, &config.DialTimeout},
+		{"ping-interval", f.PingInterval, &config.PingInterval},
+		{"client-ping-interval", f.ClientPingInterval, &config.ClientPingInterval},
+		{"index-quarantine", f.IndexQuarantine, &config.IndexQuarantine},
+		{"idle-timeout", f.IdleTimeout, &config.IdleTimeout},
+		{"max-idle-timeout", f.MaxIdleTimeout, &config.MaxIdleTimeout},
+		{"session-idle-timeout", f.SessionIdleTimeout, &config.SessionIdleTimeout},
+	}
+	for _, d := range durations {
+		if d.value == nil || explicit[d.name] {
+			continue
+		}
+		parsed, err := time.ParseDuration(*d.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+		*d.target = parsed
+	}
+
+	sizes := []struct {
+		name   string
+		value  *string
+		target *int64
+	}{
+		{"frame-size-limit", f.FrameSizeLimit, &config.FrameSizeLimit},
+		{"connect-queue-bytes", f.ConnectQueueBytes, &config.ConnectQueueBytes},
+		{"retransmit-bytes", f.RetransmitBytes, &config.RetransmitBytes},
+	}
+	for _, size := range sizes {
+		if size.value == nil || explicit[size.name] {
+			continue
+		}
+		parsed, err := units.ParseBase2Bytes(*size.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", size.name, err)
+		}
+		*size.target = int64(parsed)
+	}
+	if f.AllowedHostnames != nil && !explicit["allowed-hostnames"] {
+		config.HostnameAllowlist = f.AllowedHostnames
+	}
+	if f.ForwardableHeaders != nil && !explicit["forwardable-headers"] {
+		config.ForwardableHeaders = f.ForwardableHeaders
+	}
+	if f.ConnectQueueLimit != nil && !explicit["connect-queue-limit"] {
+		config.ConnectQueueLimit = *f.ConnectQueueLimit
+	}
+	if f.RetransmitLimit != nil && !explicit["retransmit-limit"] {
+		config.RetransmitLimit = *f.RetransmitLimit
+	}
+	if f.MonotonicIndices != nil && !explicit["monotonic-indices"] {
+		config.MonotonicIndices = *f.MonotonicIndices
+	}
+	if f.ForbidRawURLs != nil && !explicit["forbid-raw-urls"] {
+		config.ForbidRawURLs = *f.ForbidRawURLs
+	}
+	if f.SharedWrites != nil && !explicit["shared-writes"] {
+		config.SharedWrites = *f.SharedWrites
+	}
+	if f.TopicRules != nil {
+		config.TopicRules = []wsplice.TopicRule{}
+		for _, rule := range f.TopicRules {
+			config.TopicRules = append(config.TopicRules, wsplice.TopicRule{
+				Identity: rule.Identity,
+				Topics:   rule.Topics,
+				ReadOnly: rule.ReadOnly,
+			})
+		}
+	}
+	if f.Targets != nil {
+		config.Upstreams = map[string]*wsplice.Upstream{}
+		for name, target := range f.Targets {
+			upstream, err := lookup(target)
+			if err != nil {
+				return fmt.Errorf("invalid target %s: %s", name, err)
+			}
+			config.Upstreams[name] = upstream
+		}
+	}
+
+	return nil
+}
+
+// targetLookup returns the Upstream for a target.
+type targetLookup func(targetFile) (*wsplice.Upstream, error)
+
+// reusing returns a lookup which loads targets into the cache, taking
+// the Upstream from the previous cache if it has the same definition, so
+// that reloads keep the connection counts and backend health of targets
+// which didn't change.
+func (c targetCache) reusing(previous targetCache) targetLookup {
+	return func(target targetFile) (*wsplice.Upstream, error) {
+		key, err := target.definition()
+		if err != nil {
+			return nil, err
+		}
+		if upstream := c[key]; upstream != nil {
+			return upstream, nil
+		}
+		upstream := previous[key]
+		if upstream == nil {
+			if upstream, err = target.upstream(); err != nil {
+				return nil, err
+			}
+		}
+		c[key] = upstream
+		return upstream, nil
+	}
+}
+
+// definition returns a key which is the same for targets with the same
+// settings and the same contents in their TLS and schema files.
+func (f *targetFile) definition() (string, error) {
+	encoded, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write(encoded)
+	for _, path := range []*string{f.TLSCert, f.TLSKey, f.TLSCA, f.Schema} {
+		if path == nil {
+			continue
+		}
+		// Unreadable files are reported when the upstream is loaded.
+		contents, _ := ioutil.ReadFile(*path)
+		sum := sha256.Sum256(contents)
+		hash.Write(sum[:])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// upstream returns the Upstream the target describes, loading its TLS
+// files.
+func (f *targetFile) upstream() (*wsplice.Upstream, error) {
+	urls := f.Backends
+	if len(urls) == 0 {
+		urls = []string{f.URL}
+	}
+	for _, raw := range urls {
+		parsed, err := url.Parse(raw)
+		if err != nil || (parsed.Scheme != "ws" && parsed.Scheme != "wss") {
+			return nil, fmt.Errorf("url %q must be a ws:// or wss:// URL", raw)
+		}
+	}
+
+	upstream := &wsplice.Upstream{
+		URL:         f.URL,
+		Headers:     f.Headers,
+		Backends:    f.Backends,
+		Balancer:    wsplice.Balancer(f.Balancer),
+		MaxFailures: f.MaxFailures,
+	}
+	switch upstream.Balancer {
+	case "", wsplice.RoundRobin, wsplice.LeastConnections, wsplice.ConsistentHash:
+	default:
+		return nil, fmt.Errorf("unknown balancer %q", f.Balancer)
+	}
+
+	durations := []struct {
+		name   string
+		value  *string
+		target *time.Duration
+	}{
+		{"dial-timeout", f.DialTimeout, &upstream.DialTimeout},
+		{"ejection-time", f.EjectionTime, &upstream.EjectionTime},
+		{"health-check-interval", f.HealthCheckInterval, &upstream.HealthCheckInterval},
+	}
+	for _, d := range durations {
+		if d.value == nil {
+			continue
+		}
+		parsed, err := time.ParseDuration(*d.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", d.name, err)
+		}
+		*d.target = parsed
+	}
+
+	if f.Schema != nil {
+		schema, err := jsonschema.Compile(*f.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema: %s", err)
+		}
+		upstream.Schema = schema
+	}
+
+	if f.TLSCA == nil && f.TLSCert == nil {
+		return upstream, nil
+	}
+	upstream.TLSConfig = &tls.Config{}
+	if f.TLSCA != nil {
+		caCert, err := ioutil.ReadFile(*f.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		upstream.TLSConfig.RootCAs = x509.NewCertPool()
+		upstream.TLSConfig.RootCAs.AppendCertsFromPEM(caCert)
+	}
+	if f.TLSCert != nil {
+		var key string
+		if f.TLSKey != nil {
+			key = *f.TLSKey
+		}
+		cert, err := tls.LoadX509KeyPair(*f.TLSCert, key)
+		if err != nil {
+			return nil, err
+		}
+		upstream.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return upstream, nil
+}
+
+// apply copies the TLS paths in the file to the listener, except those
+// which were explicitly given as flags.
+func (f *tlsFile) apply(listener *listenerSettings, explicit map[string]bool) {
+	paths := []struct {
+		name   string
+		value  *string
+		target *string
+	}{
+		{"tls-cert", f.TLSCert, &listener.tlsCert},
+		{"tls-key", f.TLSKey, &listener.tlsKey},
+		{"tls-ca", f.TLSCA, &listener.tlsCA},
+	}
+	for _, p := range paths {
+		if p.value != nil && !explicit[p.name] {
+			*p.target = *p.value
+		}
+	}
+}
+
+// settings returns the listener's settings. Its routes' configs start from
+// the base config, keeping the explicitly given flags, and their targets are
+// loaded through the lookup.
+func (l *listenerFile) settings(base *wsplice.Config, explicit map[string]bool, lookup targetLookup) (listenerSettings, error) {
+	listener := listenerSettings{
+		listen:     l.Listen,
+		network:    l.Network,
+		healthPath: defaultHealthPath,
+		readyPath:  defaultReadyPath,
+
+		requireClientCert: l.RequireClientCert,
+	}
+	l.tlsFile.apply(&listener, nil)
+	if listener.network == "" {
+		listener.network = "tcp"
+	}
+	if l.HealthPath != nil {
+		listener.healthPath = *l.HealthPath
+	}
+	if l.ReadyPath != nil {
+		listener.readyPath = *l.ReadyPath
+	}
+	if listener.listen == "" {
+		return listener, errors.New("listen address is required")
+	}
+	if len(l.Routes) == 0 {
+		return listener, errors.New("at least one route is required")
+	}
+	switch l.Framing {
+	case "", "websocket":
+	case "raw":
+		listener.raw = true
+		listener.healthPath, listener.readyPath = "", ""
+		if len(l.Routes) > 1 {
+			return listener, errors.New("raw listeners have a single route")
+		}
+		if len(l.Routes[0].AuthTokens) > 0 {
+			return listener, errors.New("raw listeners can't require auth-tokens")
+		}
+	default:
+		return listener, fmt.Errorf("unknown framing %q", l.Framing)
+	}
+
+	for _, r := range l.Routes {
+		if listener.raw {
+			r.Path = "/"
+		}
+		if r.Path == "" || r.Path[0] != '/' {
+			return listener, fmt.Errorf("route path %q must start with a slash", r.Path)
+		}
+		if r.Path == listener.healthPath || r.Path == listener.readyPath {
+			return listener, fmt.Errorf("route path %q is used for health checks", r.Path)
+		}
+
+		config := *base
+		if err := r.serverFile.apply(&config, explicit, lookup); err != nil {
+			return listener, fmt.Errorf("route %s: %s", r.Path, err)
+		}
+		listener.routes = append(listener.routes, routeSettings{
+			path:              r.Path,
+			config:            &config,
+			authTokens:        r.AuthTokens,
+			allowedIdentities: r.AllowedIdentities,
+		})
+	}
+
+	return listener, nil
+}
+
+// upstreams returns the upstreams used by the settings' routes.
+func (s settings) upstreams() map[*wsplice.Upstream]bool {
+	upstreams := map[*wsplice.Upstream]bool{}
+	for _, listener := range s.listeners {
+		for _, route := range listener.routes {
+			for _, upstream := range route.config.Upstreams {
+				upstreams[upstream] = true
+			}
+		}
+	}
+
+	return upstreams
+}
+
+// sameLayout returns whether the settings have the same listeners and
+// routes, with the same TLS and auth settings. Only their server configs
+// may differ.
+func sameLayout(a, b settings) bool {
+	if len(a.listeners) != len(b.listeners) {
+		return false
+	}
+
+	for i := range a.listeners {
+		x, y := a.listeners[i], b.listeners[i]
+		x.routes, y.routes = nil, nil
+		if !reflect.DeepEqual(x, y) || len(a.listeners[i].routes) != len(b.listeners[i].routes) {
+			return false
+		}
+
+		for j := range a.listeners[i].routes {
+			x, y := a.listeners[i].routes[j], b.listeners[i].routes[j]
+			x.config, y.config = nil, nil
+			if !reflect.DeepEqual(x, y) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// configWatcher reloads the config file when wsplice gets a SIGHUP or when
+// the file changes, applying it to the servers.
+type configWatcher struct {
+	// servers holds the Server for each route, in the order they're listed
+	// in the settings.
+	servers  []*wsplice.Server
+	path     string
+	explicit map[string]bool
+	current  settings
+	modTime  time.Time
+}
+
+// watch reloads the config file whenever it's changed or signalled to. It
+// never returns.
+func (c *configWatcher) watch() {
+	if stat, err := os.Stat(c.path); err == nil {
+		c.modTime = stat.ModTime()
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			c.reload()
+		case <-ticker.C:
+			stat, err := os.Stat(c.path)
+			if err == nil && !stat.ModTime().Equal(c.modTime) {
+				c.modTime = stat.ModTime()
+				c.reload()
+			}
+		}
+	}
+}
+
+// reload loads the config file and applies it to the servers. Listeners,
+// routes and their TLS and auth settings can't change while wsplice is
+// running; changes to them are logged and ignored, but the new server
+// configs of routes which still exist are applied.
+func (c *configWatcher) reload() {
+	next, err := loadSettings(c.path, c.explicit, c.current.targets)
+	if err != nil {
+		logrus.WithError(err).Error("Error reloading config file, keeping the current configuration")
+		return
+	}
+
+	if !sameLayout(c.current, next) {
+		logrus.Warn("Ignoring changes to listeners, routes, TLS and auth settings in the config file, " +
+			"wsplice must be restarted to apply them")
+	}
+
+	previous := c.current.upstreams()
+	configs := map[[2]string]*wsplice.Config{}
+	for _, listener := range next.listeners {
+		for _, route := range listener.routes {
+			configs[[2]string{listener.listen, route.path}] = route.config
+		}
+	}
+
+	i := 0
+	for _, listener := range c.current.listeners {
+		for j, route := range listener.routes {
+			if config := configs[[2]string{listener.listen, route.path}]; config != nil {
+				listener.routes[j].config = config
+				c.servers[i].SetConfig(config)
+			}
+			i++
+		}
+	}
+	c.current.config = next.config
+	c.current.targets = next.targets
+
+	// Check the health of the new upstreams, and stop checking the ones
+	// which were replaced.
+	current := c.current.upstreams()
+	for upstream := range current {
+		upstream.StartHealthChecks()
+	}
+	for upstream := range previous {
+		if !current[upstream] {
+			upstream.StopHealthChecks()
+		}
+	}
+
+	logrus.WithField("path", c.path).Info("Reloaded config file")
+}
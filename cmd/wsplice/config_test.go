@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mixer/wsplice"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// writeConfig writes the contents to a config file with the name in a
+// temporary directory, returning its path.
+func writeConfig(t *testing.T, name, contents string) string {
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, name)
+	require.Nil(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	return path
+}
+
+func parseFlags(t *testing.T, args ...string) map[string]bool {
+	_, err := kingpin.CommandLine.Parse(args)
+	require.Nil(t, err)
+	explicit, err := explicitFlags(kingpin.CommandLine, args)
+	require.Nil(t, err)
+	return explicit
+}
+
+func TestLoadsConfigFiles(t *testing.T) {
+	files := map[string]string{
+		"wsplice.yaml": `
+dial-timeout: 7s
+write-timeout: 2s
+frame-size-limit: 1MB
+allowed-hostnames: [example.com]
+forwardable-headers: [Cookie]
+monotonic-indices: true
+shared-writes: true
+retransmit-limit: 100
+retransmit-bytes: 64KB
+tls-cert: cert.pem
+`,
+		"wsplice.toml": `
+dial-timeout = "7s"
+write-timeout = "2s"
+frame-size-limit = "1MB"
+allowed-hostnames = ["example.com"]
+forwardable-headers = ["Cookie"]
+monotonic-indices = true
+shared-writes = true
+retransmit-limit = 100
+retransmit-bytes = "64KB"
+tls-cert = "cert.pem"
+`,
+	}
+
+	for name, contents := range files {
+		explicit := parseFlags(t, "--dial-timeout=3s")
+		s, err := loadSettings(writeConfig(t, name, contents), explicit, nil)
+		require.Nil(t, err, name)
+
+		require.Equal(t, 3*time.Second, s.config.DialTimeout, name)
+		require.Equal(t, 2*time.Second, s.config.WriteTimeout, name)
+		require.Equal(t, 5*time.Second, s.config.ReadTimeout, name)
+		require.Equal(t, int64(1024*1024), s.config.FrameSizeLimit, name)
+		require.Equal(t, []string{"example.com"}, s.config.HostnameAllowlist, name)
+		require.Equal(t, []string{"Cookie"}, s.config.ForwardableHeaders, name)
+		require.True(t, s.config.MonotonicIndices, name)
+		require.True(t, s.config.SharedWrites, name)
+		require.Equal(t, 100, s.config.RetransmitLimit, name)
+		require.Equal(t, int64(64*1024), s.config.RetransmitBytes, name)
+		require.Equal(t, "cert.pem", s.listeners[0].tlsCert, name)
+	}
+}
+
+func TestRejectsInvalidConfigFiles(t *testing.T) {
+	explicit := parseFlags(t)
+
+	_, err := loadSettings(writeConfig(t, "wsplice.yaml", "idle-timeout: soon"), explicit, nil)
+	require.EqualError(t, err, `invalid idle-timeout: time: invalid duration "soon"`)
+
+	_, err = loadSettings(writeConfig(t, "wsplice.toml", "idle-timeout = ["), explicit, nil)
+	require.NotNil(t, err)
+}
+
+func TestReloadsConfigFiles(t *testing.T) {
+	explicit := parseFlags(t)
+	path := writeConfig(t, "wsplice.yaml", "idle-timeout: 1m\ntls-cert: cert.pem")
+	s, err := loadSettings(path, explicit, nil)
+	require.Nil(t, err)
+
+	watcher := &configWatcher{servers: []*wsplice.Server{{Config: s.config}}, path: path, explicit: explicit, current: s}
+	require.Nil(t, ioutil.WriteFile(path, []byte("idle-timeout: 2m\ntls-cert: other.pem"), 0644))
+	watcher.reload()
+
+	require.Equal(t, 2*time.Minute, watcher.current.listeners[0].routes[0].config.IdleTimeout)
+	require.Equal(t, "cert.pem", watcher.current.listeners[0].tlsCert)
+}
+
+func TestReloadKeepsUnchangedTargets(t *testing.T) {
+	explicit := parseFlags(t)
+	path := writeConfig(t, "wsplice.yaml", "targets: {chat: {url: 'ws://chat'}, news: {url: 'ws://news'}}")
+	s, err := loadSettings(path, explicit, nil)
+	require.Nil(t, err)
+	chat, news := s.config.Upstreams["chat"], s.config.Upstreams["news"]
+
+	watcher := &configWatcher{servers: []*wsplice.Server{{Config: s.config}}, path: path, explicit: explicit, current: s}
+	require.Nil(t, ioutil.WriteFile(path, []byte("targets: {chat: {url: 'ws://chat'}, news: {url: 'ws://news-2'}}"), 0644))
+	watcher.reload()
+
+	upstreams := watcher.current.listeners[0].routes[0].config.Upstreams
+	require.True(t, chat == upstreams["chat"])
+	require.False(t, news == upstreams["news"])
+	require.Equal(t, "ws://news-2", upstreams["news"].URL)
+}
+
+func TestLoadsTopicRules(t *testing.T) {
+	files := map[string]string{
+		"wsplice.yaml": `
+topic-rules:
+  - {identity: "*.example.com", topics: ["rooms/*"]}
+  - {identity: "*", topics: [news], read-only: true}
+`,
+		"wsplice.toml": `
+[[topic-rules]]
+identity = "*.example.com"
+topics = ["rooms/*"]
+
+[[topic-rules]]
+identity = "*"
+topics = ["news"]
+read-only = true
+`,
+	}
+
+	for name, contents := range files {
+		s, err := loadSettings(writeConfig(t, name, contents), parseFlags(t), nil)
+		require.Nil(t, err, name)
+		require.Equal(t, []wsplice.TopicRule{
+			{Identity: "*.example.com", Topics: []string{"rooms/*"}},
+			{Identity: "*", Topics: []string{"news"}, ReadOnly: true},
+		}, s.config.TopicRules, name)
+	}
+}
+
+func TestLoadsTargets(t *testing.T) {
+	files := map[string]string{
+		"wsplice.yaml": `
+forbid-raw-urls: true
+targets:
+  chat:
+    url: wss://chat.internal/ws
+    headers: {Authorization: Bearer secret}
+    dial-timeout: 2s
+`,
+		"wsplice.toml": `
+forbid-raw-urls = true
+[targets.chat]
+url = "wss://chat.internal/ws"
+headers = {Authorization = "Bearer secret"}
+dial-timeout = "2s"
+`,
+	}
+
+	for name, contents := range files {
+		s, err := loadSettings(writeConfig(t, name, contents), parseFlags(t), nil)
+		require.Nil(t, err, name)
+		require.True(t, s.config.ForbidRawURLs, name)
+		require.Equal(t, &wsplice.Upstream{
+			URL:         "wss://chat.internal/ws",
+			Headers:     map[string]string{"Authorization": "Bearer secret"},
+			DialTimeout: 2 * time.Second,
+		}, s.config.Upstreams["chat"], name)
+	}
+
+	_, err := loadSettings(writeConfig(t, "wsplice.yaml", "targets: {chat: {url: 'http://chat.internal'}}"), parseFlags(t), nil)
+	require.EqualError(t, err, `invalid target chat: url "http://chat.internal" must be a ws:// or wss:// URL`)
+}
+
+func TestLoadsTargetSchemas(t *testing.T) {
+	schema := writeConfig(t, "chat.json", `{"type": "object", "required": ["text"]}`)
+	s, err := loadSettings(writeConfig(t, "wsplice.yaml", "targets: {chat: {url: 'ws://chat.internal', schema: '"+schema+"'}}"), parseFlags(t), nil)
+	require.Nil(t, err)
+	require.NotNil(t, s.config.Upstreams["chat"].Schema)
+	require.NotNil(t, s.config.Upstreams["chat"].Schema.Validate(map[string]interface{}{}))
+
+	invalid := writeConfig(t, "chat.json", `{"type": 5}`)
+	_, err = loadSettings(writeConfig(t, "wsplice.yaml", "targets: {chat: {url: 'ws://chat.internal', schema: '"+invalid+"'}}"), parseFlags(t), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "invalid target chat: invalid schema")
+}
+
+func TestLoadsPooledTargets(t *testing.T) {
+	s, err := loadSettings(writeConfig(t, "wsplice.yaml", `
+targets:
+  chat:
+    backends: [ws://chat-1.internal, ws://chat-2.internal]
+    balancer: consistent-hash
+    max-failures: 5
+    ejection-time: 1m
+    health-check-interval: 10s
+`), parseFlags(t), nil)
+	require.Nil(t, err)
+	require.Equal(t, &wsplice.Upstream{
+		Backends:            []string{"ws://chat-1.internal", "ws://chat-2.internal"},
+		Balancer:            wsplice.ConsistentHash,
+		MaxFailures:         5,
+		EjectionTime:        time.Minute,
+		HealthCheckInterval: 10 * time.Second,
+	}, s.config.Upstreams["chat"])
+
+	_, err = loadSettings(writeConfig(t, "wsplice.yaml", "targets: {chat: {backends: ['ws://chat'], balancer: random}}"), parseFlags(t), nil)
+	require.EqualError(t, err, `invalid target chat: unknown balancer "random"`)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/mixer/wsplice"
+	"github.com/sirupsen/logrus"
+)
+
+// routeHandler checks that clients may use a route before passing them on
+// to its Server.
+type routeHandler struct {
+	server            *wsplice.Server
+	authTokens        []string
+	allowedIdentities []string
+}
+
+func (h *routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	h.server.ServeHTTP(w, r)
+}
+
+func (h *routeHandler) authorized(r *http.Request) bool {
+	if len(h.authTokens) > 0 {
+		token := bearerToken(r)
+		var ok bool
+		for _, allowed := range h.authTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				ok = true
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+
+	return identityAllowed(r.TLS, h.allowedIdentities)
+}
+
+// identityAllowed returns whether the common name of the client certificate
+// on the TLS connection is one of the allowed identities. If none are
+// given, every client is allowed.
+func identityAllowed(state *tls.ConnectionState, allowedIdentities []string) bool {
+	if len(allowedIdentities) == 0 {
+		return true
+	}
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return false
+	}
+
+	identity := state.VerifiedChains[0][0].Subject.CommonName
+	for _, allowed := range allowedIdentities {
+		if identity == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// bearerToken returns the token in the request's Authorization header, or
+// an empty string if there isn't one.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+
+	return header[len(prefix):]
+}
+
+// createOriginPolicy returns the policy for the allowed origins, which
+// may be regular expressions between slashes, or nil if any origin is
+// allowed and the upstream origin isn't changed.
+func createOriginPolicy(origins []string, forward bool, rewrite string) (*wsplice.OriginPolicy, error) {
+	if len(origins) == 0 && !forward && rewrite == "" {
+		return nil, nil
+	}
+
+	policy := &wsplice.OriginPolicy{Forward: forward, Rewrite: rewrite}
+	for _, origin := range origins {
+		if len(origin) < 2 || origin[0] != '/' || origin[len(origin)-1] != '/' {
+			policy.Origins = append(policy.Origins, origin)
+			continue
+		}
+
+		pattern, err := regexp.Compile("^(?:" + origin[1:len(origin)-1] + ")$")
+		if err != nil {
+			return nil, err
+		}
+		policy.Patterns = append(policy.Patterns, pattern)
+	}
+	if len(origins) == 0 {
+		policy.Origins = []string{"*"}
+	}
+
+	return policy, nil
+}
+
+// serveHealth responds to liveness checks, which aren't upgraded to
+// websockets.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok\n"))
+}
+
+// createHandler routes the listener's paths to their servers, which are
+// created by newServer. The listener is ready when all of its servers are.
+func createHandler(listener listenerSettings, newServer func(*wsplice.Config) *wsplice.Server) http.Handler {
+	mux := http.NewServeMux()
+	if listener.healthPath != "" {
+		mux.HandleFunc(listener.healthPath, serveHealth)
+	}
+
+	var servers []*wsplice.Server
+	for _, route := range listener.routes {
+		server := newServer(route.config)
+		servers = append(servers, server)
+		mux.Handle(route.path, &routeHandler{
+			server:            server,
+			authTokens:        route.authTokens,
+			allowedIdentities: route.allowedIdentities,
+		})
+	}
+
+	if listener.readyPath != "" {
+		mux.Handle(listener.readyPath, wsplice.CombinedReadinessHandler(servers...))
+	}
+
+	return mux
+}
+
+// listen opens the listener's address, with TLS if it has a certificate.
+func listen(listener listenerSettings) (net.Listener, error) {
+	if listener.tlsCert == "" {
+		return net.Listen(listener.network, listener.listen)
+	}
+
+	config, err := createTLSConfig(listener)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Listen(listener.network, listener.listen, config)
+}
+
+func createTLSConfig(listener listenerSettings) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(listener.tlsCert, listener.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if listener.tlsCA != "" {
+		caCert, err := ioutil.ReadFile(listener.tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(caCert)
+		config.ClientCAs = certPool
+		// Clients' certificates give their identities, for allowed-identities,
+		// topic rules and the access log. Unless they're required, clients
+		// without one may still connect, and just have no identity.
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if listener.requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return config, nil
+}
+
+// serve serves the handler on the listener, sending any error to errs.
+func serve(listener net.Listener, handler http.Handler, errs chan<- error) {
+	logrus.Infof("wsplice listening on %s", listener.Addr())
+	errs <- (&http.Server{Handler: handler}).Serve(listener)
+}
+
+// serveRaw serves raw sessions on the listener with the route's server,
+// sending any error accepting connections to errs.
+func serveRaw(listener net.Listener, server *wsplice.Server, route routeSettings, errs chan<- error) {
+	logrus.Infof("wsplice listening for raw connections on %s", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		go func() {
+			if !rawAuthorized(conn, route.allowedIdentities) {
+				conn.Close()
+				return
+			}
+			server.ServeRaw(context.Background(), conn)
+		}()
+	}
+}
+
+// rawAuthorized returns whether the client on a raw connection is one of the
+// allowed identities, completing the TLS handshake if there is one.
+func rawAuthorized(conn net.Conn, allowedIdentities []string) bool {
+	if len(allowedIdentities) == 0 {
+		return true
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok || tlsConn.Handshake() != nil {
+		return false
+	}
+
+	state := tlsConn.ConnectionState()
+	return identityAllowed(&state, allowedIdentities)
+}
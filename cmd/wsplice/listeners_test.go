@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mixer/wsplice"
+	"github.com/stretchr/testify/require"
+)
+
+const listenersConfig = `
+allowed-hostnames: [example.com]
+dial-timeout: 5s
+listeners:
+  - listen: 0.0.0.0:443
+    tls-cert: public.pem
+    tls-key: public-key.pem
+    tls-require-client-cert: true
+    routes:
+      - path: /chat
+        auth-tokens: [secret]
+      - path: /feeds
+        dial-timeout: 1s
+        allowed-hostnames: [feeds.example.com]
+  - listen: 127.0.0.1:3000
+    health-path: ""
+    routes:
+      - path: /
+  - listen: /run/wsplice.sock
+    network: unix
+    framing: raw
+    routes:
+      - idle-timeout: 1m
+`
+
+func TestLoadsListeners(t *testing.T) {
+	s, err := loadSettings(writeConfig(t, "wsplice.yaml", listenersConfig), parseFlags(t), nil)
+	require.Nil(t, err)
+	require.Len(t, s.listeners, 3)
+
+	public := s.listeners[0]
+	require.Equal(t, "0.0.0.0:443", public.listen)
+	require.Equal(t, "tcp", public.network)
+	require.Equal(t, "public.pem", public.tlsCert)
+	require.True(t, public.requireClientCert)
+	require.Equal(t, "/healthz", public.healthPath)
+	require.Equal(t, "/readyz", public.readyPath)
+	require.Len(t, public.routes, 2)
+	require.Equal(t, []string{"secret"}, public.routes[0].authTokens)
+	require.Equal(t, 5*time.Second, public.routes[0].config.DialTimeout)
+	require.Equal(t, []string{"example.com"}, public.routes[0].config.HostnameAllowlist)
+	require.Equal(t, time.Second, public.routes[1].config.DialTimeout)
+	require.Equal(t, []string{"feeds.example.com"}, public.routes[1].config.HostnameAllowlist)
+
+	internal := s.listeners[1]
+	require.Equal(t, "", internal.healthPath)
+	require.Equal(t, "/readyz", internal.readyPath)
+	require.Equal(t, "", internal.tlsCert)
+	require.False(t, internal.requireClientCert)
+	require.Equal(t, "/", internal.routes[0].path)
+	require.False(t, internal.raw)
+
+	raw := s.listeners[2]
+	require.True(t, raw.raw)
+	require.Equal(t, "unix", raw.network)
+	require.Equal(t, "", raw.healthPath)
+	require.Equal(t, "", raw.readyPath)
+	require.Equal(t, time.Minute, raw.routes[0].config.IdleTimeout)
+}
+
+func TestRejectsInvalidListeners(t *testing.T) {
+	explicit := parseFlags(t)
+	tt := map[string]string{
+		"listeners: [{routes: [{path: /}]}]":                                       "invalid listener 0: listen address is required",
+		"listeners: [{listen: ':80'}]":                                             "invalid listener 0: at least one route is required",
+		"listeners: [{listen: ':80', routes: [{path: chat}]}]":                     `invalid listener 0: route path "chat" must start with a slash`,
+		"listeners: [{listen: ':80', routes: [{path: /healthz}]}]":                 `invalid listener 0: route path "/healthz" is used for health checks`,
+		"listeners: [{listen: ':80', routes: [{path: /readyz}]}]":                  `invalid listener 0: route path "/readyz" is used for health checks`,
+		"listeners: [{listen: ':80', framing: raw, routes: [{}, {}]}]":             "invalid listener 0: raw listeners have a single route",
+		"listeners: [{listen: ':80', framing: raw, routes: [{auth-tokens: [a]}]}]": "invalid listener 0: raw listeners can't require auth-tokens",
+		"listeners: [{listen: ':80', framing: http2, routes: [{path: /}]}]":        `invalid listener 0: unknown framing "http2"`,
+	}
+
+	for contents, expected := range tt {
+		_, err := loadSettings(writeConfig(t, "wsplice.yaml", contents), explicit, nil)
+		require.EqualError(t, err, expected)
+	}
+}
+
+func TestPrefersFlagsToRouteSettings(t *testing.T) {
+	s, err := loadSettings(writeConfig(t, "wsplice.yaml", listenersConfig), parseFlags(t, "--dial-timeout=3s"), nil)
+	require.Nil(t, err)
+	require.Equal(t, 3*time.Second, s.listeners[0].routes[0].config.DialTimeout)
+	require.Equal(t, 3*time.Second, s.listeners[0].routes[1].config.DialTimeout)
+	require.Equal(t, []string{"feeds.example.com"}, s.listeners[0].routes[1].config.HostnameAllowlist)
+}
+
+func TestRejectsListenerFlagsWithFileListeners(t *testing.T) {
+	path := writeConfig(t, "wsplice.yaml", listenersConfig)
+	for _, args := range [][]string{{"--listen=0.0.0.0:80"}, {"--tls-cert=cert.pem"}, {"--tls-require-client-cert"}} {
+		_, err := loadSettings(path, parseFlags(t, args...), nil)
+		require.NotNil(t, err, args[0])
+	}
+
+	_, err := loadSettings(writeConfig(t, "wsplice.yaml", "dial-timeout: 1s"), parseFlags(t, "--listen=0.0.0.0:80"), nil)
+	require.Nil(t, err)
+}
+
+func TestKeepsListenersWhenReloading(t *testing.T) {
+	explicit := parseFlags(t)
+	path := writeConfig(t, "wsplice.yaml", listenersConfig)
+	s, err := loadSettings(path, explicit, nil)
+	require.Nil(t, err)
+
+	servers := []*wsplice.Server{{}, {}, {}, {}}
+	watcher := &configWatcher{servers: servers, path: path, explicit: explicit, current: s}
+	require.Nil(t, ioutil.WriteFile(path, []byte(`
+dial-timeout: 3s
+listeners:
+  - listen: 0.0.0.0:443
+    routes:
+      - path: /chat
+`), 0644))
+	watcher.reload()
+
+	// The /chat route gets its new config, but keeps its auth tokens, and
+	// the other routes are left alone.
+	require.Equal(t, 3*time.Second, watcher.current.listeners[0].routes[0].config.DialTimeout)
+	require.Equal(t, []string{"secret"}, watcher.current.listeners[0].routes[0].authTokens)
+	require.Equal(t, time.Second, watcher.current.listeners[0].routes[1].config.DialTimeout)
+	require.Len(t, watcher.current.listeners, 3)
+}
+
+func TestRoutesRequests(t *testing.T) {
+	s, err := loadSettings(writeConfig(t, "wsplice.yaml", listenersConfig), parseFlags(t), nil)
+	require.Nil(t, err)
+
+	var servers []*wsplice.Server
+	handler := createHandler(s.listeners[0], func(config *wsplice.Config) *wsplice.Server {
+		server := &wsplice.Server{Config: config}
+		servers = append(servers, server)
+		return server
+	})
+	require.Len(t, servers, 2)
+
+	tt := []struct {
+		path, token string
+		status      int
+	}{
+		{"/healthz", "", http.StatusOK},
+		{"/readyz", "", http.StatusOK},
+		{"/chat", "", http.StatusUnauthorized},
+		{"/chat", "wrong", http.StatusUnauthorized},
+		// Requests which are allowed through, but aren't websocket upgrades.
+		{"/chat", "secret", http.StatusBadRequest},
+		{"/feeds", "", http.StatusBadRequest},
+		{"/other", "", http.StatusNotFound},
+	}
+
+	for _, test := range tt {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, test.status, rec.Code, "%s with token %q", test.path, test.token)
+	}
+
+	// The listener isn't ready once any of its servers is draining.
+	servers[1].Drain()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.JSONEq(t, `{"ready":false,"checks":{"draining":"server is draining"}}`, rec.Body.String())
+}
+
+func TestCreatesOriginPolicies(t *testing.T) {
+	policy, err := createOriginPolicy(nil, false, "")
+	require.Nil(t, err)
+	require.Nil(t, policy)
+
+	policy, err = createOriginPolicy([]string{"https://*.example.com", `/^https://example\.(com|org)$/`}, false, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{"https://*.example.com"}, policy.Origins)
+	require.True(t, policy.Allows("https://example.org"))
+	require.False(t, policy.Allows("https://evil.com"))
+
+	policy, err = createOriginPolicy([]string{`/https://app\.example\.(com|org)/`}, false, "")
+	require.Nil(t, err)
+	require.True(t, policy.Allows("https://app.example.org"))
+	require.False(t, policy.Allows("https://app.example.com.evil.net"))
+	require.False(t, policy.Allows("https://evil.net/https://app.example.com"))
+
+	policy, err = createOriginPolicy(nil, true, "")
+	require.Nil(t, err)
+	require.True(t, policy.Forward)
+	require.True(t, policy.Allows("https://evil.com"))
+
+	_, err = createOriginPolicy([]string{"/(/"}, false, "")
+	require.NotNil(t, err)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gobwas/ws"
+	"github.com/mixer/wsplice"
+	"github.com/sirupsen/logrus"
+)
+
+// controlIndex is the index of wsplice's control channel.
+const controlIndex = 0xffff
+
+// replayCloseTimeout is how long a replay waits for wsplice to close the
+// session once the recording has been replayed.
+const replayCloseTimeout = time.Second
+
+// replay runs the "replay" command. Without --to or --mock-upstream, it
+// prints the recording.
+func replay() {
+	header, frames, err := readRecording(*replayPath)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error reading recording")
+	}
+	if *replayTo == "" && *replayMockUpstream == "" {
+		printRecording(os.Stdout, header, frames)
+		return
+	}
+
+	if *replayMockUpstream != "" {
+		ln, err := net.Listen("tcp", *replayMockUpstream)
+		if err != nil {
+			logrus.WithError(err).Fatal("Error creating network listener")
+		}
+		logrus.WithField("address", ln.Addr().String()).Info("Serving mock upstream")
+		go serveMockUpstream(ln, frames, *replaySpeed)
+		if *replayTo == "" {
+			select {}
+		}
+	}
+
+	if err := replayClient(context.Background(), *replayTo, frames, *replaySpeed, os.Stdout); err != nil {
+		logrus.WithError(err).Fatal("Error replaying recording")
+	}
+}
+
+// readRecording reads every frame of the recording at the path. Recordings
+// which were cut off are read up to the last whole frame.
+func readRecording(path string) (wsplice.RecordingHeader, []wsplice.RecordedFrame, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return wsplice.RecordingHeader{}, nil, err
+	}
+	defer file.Close()
+
+	reader, err := wsplice.NewRecordingReader(file)
+	if err != nil {
+		return wsplice.RecordingHeader{}, nil, err
+	}
+
+	var frames []wsplice.RecordedFrame
+	for {
+		frame, err := reader.Next()
+		switch err {
+		case nil:
+			frames = append(frames, frame)
+		case io.EOF:
+			return reader.Header, frames, nil
+		case io.ErrUnexpectedEOF:
+			logrus.Warn("The recording was cut off, replaying it up to the last whole frame")
+			return reader.Header, frames, nil
+		default:
+			return reader.Header, nil, err
+		}
+	}
+}
+
+// printRecording writes the session and each of its frames on its own line.
+func printRecording(w io.Writer, header wsplice.RecordingHeader, frames []wsplice.RecordedFrame) {
+	fmt.Fprintf(w, "session %s from %s", header.SessionID, header.RemoteAddr)
+	if header.Identity != "" {
+		fmt.Fprintf(w, " (%s)", header.Identity)
+	}
+	fmt.Fprintf(w, " at %s\n", header.StartedAt.Format(time.RFC3339Nano))
+
+	for _, frame := range frames {
+		printFrame(w, frame)
+	}
+}
+
+// printFrame writes the frame on a line, with its payload as text if it's
+// valid UTF-8 or hex if not.
+func printFrame(w io.Writer, frame wsplice.RecordedFrame) {
+	arrow := "->"
+	if frame.Direction == wsplice.RemoteToClient {
+		arrow = "<-"
+	}
+	payload := string(frame.Payload)
+	if !utf8.Valid(frame.Payload) {
+		payload = hex.EncodeToString(frame.Payload)
+	}
+
+	fmt.Fprintf(w, "%12s %s %5d %s %s\n", frame.Time.Round(time.Microsecond), arrow, frame.Index, opName(frame.OpCode), payload)
+}
+
+// opName returns a short name for the opcode.
+func opName(opCode ws.OpCode) string {
+	switch opCode {
+	case ws.OpContinuation:
+		return "cont "
+	case ws.OpText:
+		return "text "
+	case ws.OpBinary:
+		return "bin  "
+	case ws.OpClose:
+		return "close"
+	default:
+		return fmt.Sprintf("op%-3d", opCode)
+	}
+}
+
+// waitUntil sleeps until the frame's time in the recording, from the start
+// of the replay, sped up by the speed. A speed of 0 doesn't wait at all.
+func waitUntil(start time.Time, at time.Duration, speed float64) {
+	if speed <= 0 {
+		return
+	}
+	time.Sleep(time.Until(start.Add(time.Duration(float64(at) / speed))))
+}
+
+// replayClient plays the client's side of the recording against the wsplice
+// server at the URL, sending the frames it sent at the times it sent them,
+// and printing the frames the server sends back. Once the recording ends, it
+// closes the session, unless the client closed it in the recording.
+func replayClient(ctx context.Context, url string, frames []wsplice.RecordedFrame, speed float64, out io.Writer) error {
+	conn, _, err := ws.Dial(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		readReplayed(conn, start, &mu, out)
+	}()
+
+	var (
+		end    time.Duration
+		closed bool
+	)
+	for _, frame := range frames {
+		if frame.Time > end {
+			end = frame.Time
+		}
+		if frame.Direction != wsplice.ClientToRemote {
+			continue
+		}
+
+		waitUntil(start, frame.Time, speed)
+		payload := frame.Payload
+		if frame.OpCode == ws.OpText || frame.OpCode == ws.OpBinary {
+			payload = make([]byte, 2+len(frame.Payload))
+			binary.BigEndian.PutUint16(payload, uint16(frame.Index))
+			copy(payload[2:], frame.Payload)
+		}
+		if err := ws.WriteFrame(conn, ws.MaskFrame(ws.NewFrame(frame.OpCode, frame.Fin, payload))); err != nil {
+			return err
+		}
+		mu.Lock()
+		frame.Time = time.Since(start)
+		printFrame(out, frame)
+		mu.Unlock()
+
+		if frame.OpCode == ws.OpClose {
+			closed = true
+			break
+		}
+	}
+
+	if !closed {
+		waitUntil(start, end, speed)
+		ws.WriteFrame(conn, ws.MaskFrame(ws.NewCloseFrame(ws.StatusNormalClosure, "")))
+	}
+	select {
+	case <-done:
+	case <-time.After(replayCloseTimeout):
+	}
+
+	return nil
+}
+
+// readReplayed prints the frames wsplice sends during a replay, until the
+// connection is closed.
+func readReplayed(conn net.Conn, start time.Time, mu *sync.Mutex, out io.Writer) {
+	index := 0
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+
+		payload := frame.Payload
+		switch frame.Header.OpCode {
+		case ws.OpText, ws.OpBinary:
+			if len(payload) >= 2 {
+				index = int(binary.BigEndian.Uint16(payload))
+				payload = payload[2:]
+			}
+		case ws.OpContinuation:
+		case ws.OpClose:
+			index = 0
+		default:
+			continue
+		}
+
+		mu.Lock()
+		printFrame(out, wsplice.RecordedFrame{
+			Time:      time.Since(start),
+			Direction: wsplice.RemoteToClient,
+			Index:     index,
+			OpCode:    frame.Header.OpCode,
+			Fin:       frame.Header.Fin,
+			Payload:   payload,
+		})
+		mu.Unlock()
+
+		if frame.Header.OpCode == ws.OpClose {
+			return
+		}
+	}
+}
+
+// serveMockUpstream serves websockets on the listener which play the part of
+// the remote servers in the recording. The first connection gets the frames
+// wsplice sent the client from the first index used in the recording, the
+// second those from the second, and so on, timed from the first frame of
+// that index in either direction. What the mock is sent is discarded.
+func serveMockUpstream(ln net.Listener, frames []wsplice.RecordedFrame, speed float64) error {
+	byIndex := map[int][]wsplice.RecordedFrame{}
+	var indices []int
+	for _, frame := range frames {
+		if frame.Index == controlIndex || frame.OpCode == ws.OpClose {
+			continue
+		}
+		if _, ok := byIndex[frame.Index]; !ok {
+			indices = append(indices, frame.Index)
+			byIndex[frame.Index] = nil
+		}
+		byIndex[frame.Index] = append(byIndex[frame.Index], frame)
+	}
+
+	var (
+		mu   sync.Mutex
+		next int
+	)
+	return http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _, err := ws.UpgradeHTTP(r, w, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		mu.Lock()
+		var recorded []wsplice.RecordedFrame
+		if next < len(indices) {
+			recorded = byIndex[indices[next]]
+		}
+		next++
+		mu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			discardFrames(conn)
+		}()
+		start := time.Now()
+		for _, frame := range recorded {
+			if frame.Direction != wsplice.RemoteToClient {
+				continue
+			}
+			waitUntil(start, frame.Time-recorded[0].Time, speed)
+			if err := ws.WriteFrame(conn, ws.NewFrame(frame.OpCode, frame.Fin, frame.Payload)); err != nil {
+				return
+			}
+		}
+
+		// Keep the connection open until wsplice closes it.
+		<-done
+	}))
+}
+
+// discardFrames reads frames off the connection until it's closed, replying
+// to close frames.
+func discardFrames(conn net.Conn) {
+	for {
+		frame, err := ws.ReadFrame(conn)
+		if err != nil {
+			return
+		}
+		if frame.Header.OpCode == ws.OpClose {
+			ws.WriteFrame(conn, ws.NewCloseFrame(ws.StatusNormalClosure, ""))
+			conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/mixer/wsplice"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplaysRecordings(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer upstream.Close()
+	go serveMockUpstream(upstream, []wsplice.RecordedFrame{
+		{Time: 50 * time.Millisecond, Direction: wsplice.ClientToRemote, Index: 0, OpCode: ws.OpText, Fin: true, Payload: []byte(`"hi"`)},
+		{Time: 100 * time.Millisecond, Direction: wsplice.RemoteToClient, Index: 0, OpCode: ws.OpText, Fin: true, Payload: []byte(`"welcome"`)},
+	}, 1)
+
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	server := &wsplice.Server{
+		Config: &wsplice.Config{
+			FrameSizeLimit:    1024,
+			ReadTimeout:       time.Second,
+			WriteTimeout:      time.Second,
+			DialTimeout:       time.Second,
+			HostnameAllowlist: []string{"127.0.0.1"},
+		},
+		Recorder: &wsplice.Recorder{Dir: dir, SampleRate: 1},
+	}
+	splice := httptest.NewServer(server)
+	defer splice.Close()
+
+	connect := `{"id":1,"type":"method","method":"connect","params":{"url":"ws://` + upstream.Addr().String() + `"}}`
+	var out bytes.Buffer
+	require.Nil(t, replayClient(context.Background(), "ws:"+splice.URL[5:], []wsplice.RecordedFrame{
+		{Direction: wsplice.ClientToRemote, Index: controlIndex, OpCode: ws.OpBinary, Fin: true, Payload: []byte(connect)},
+		{Time: 50 * time.Millisecond, Direction: wsplice.ClientToRemote, Index: 0, OpCode: ws.OpBinary, Fin: true, Payload: []byte(`"hi"`)},
+		{Time: 200 * time.Millisecond, Direction: wsplice.RemoteToClient, Index: 0, OpCode: ws.OpText, Fin: true, Payload: []byte(`"welcome"`)},
+	}, 1, &out))
+	require.Contains(t, out.String(), `-> 65535 bin   `+connect)
+	require.Contains(t, out.String(), `<- 65535 text  {"id":1,"type":"reply","result":{"index":0}}`)
+	require.Contains(t, out.String(), `->     0 bin   "hi"`)
+	require.Contains(t, out.String(), `<-     0 text  "welcome"`)
+
+	// The replay was itself recorded.
+	require.Eventually(t, func() bool { return len(server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+	files, err := filepath.Glob(filepath.Join(dir, "*.wsrec"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	header, frames, err := readRecording(files[0])
+	require.Nil(t, err)
+	var printed bytes.Buffer
+	printRecording(&printed, header, frames)
+	lines := strings.Split(strings.TrimSpace(printed.String()), "\n")
+	require.Len(t, lines, 6)
+	require.True(t, strings.HasPrefix(lines[0], "session "+header.SessionID+" from 127.0.0.1:"))
+	require.True(t, strings.HasSuffix(lines[1], `-> 65535 bin   `+connect))
+	require.True(t, strings.HasSuffix(lines[2], `<- 65535 text  {"id":1,"type":"reply","result":{"index":0}}`))
+	require.True(t, strings.HasSuffix(lines[3], `->     0 bin   "hi"`))
+	require.True(t, strings.HasSuffix(lines[4], `<-     0 text  "welcome"`))
+	require.True(t, strings.HasSuffix(lines[5], `->     0 close 03e8`))
+
+	_, _, err = readRecording(writeConfig(t, "session.wsrec", "not a recording"))
+	require.Equal(t, wsplice.ErrNotRecording, err)
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func newSyslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "wsplice")
+}
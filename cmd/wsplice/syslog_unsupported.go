@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+func newSyslogWriter() (io.Writer, error) {
+	return nil, fmt.Errorf("syslog is not supported on %s", runtime.GOOS)
+}
@@ -1,95 +1,247 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"io/ioutil"
-	"log"
-	"net"
+	"context"
+	"io"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"net/http"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/mixer/wsplice"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
 var version = "master" // overwritten by goreleaser
 
 var (
-	host             = kingpin.Flag("listen", "Host and port to listen on.").Default("127.0.0.1:3000").String()
-	network          = kingpin.Flag("network", "Network to listen on, should be either 'tcp' or 'tcp6' for IPv6 support").Default("tcp").String()
-	allowedHostnames = kingpin.Flag("allowed-hostnames", "List of hostnames the server is allowed to connect dial out to.").Strings()
-	pprofServer      = kingpin.Flag("pprof-address", "Address to host the pprof server on. This should not be exposed publicly. "+
+	host               = kingpin.Flag("listen", "Host and port to listen on.").Default("127.0.0.1:3000").String()
+	network            = kingpin.Flag("network", "Network to listen on, should be either 'tcp' or 'tcp6' for IPv6 support").Default("tcp").String()
+	allowedHostnames   = kingpin.Flag("allowed-hostnames", "List of hostnames the server is allowed to connect dial out to.").Strings()
+	forbidRawURLs      = kingpin.Flag("forbid-raw-urls", "Only let clients connect to the targets named in the config file, not to URLs").Bool()
+	sharedWrites       = kingpin.Flag("shared-writes", "Let clients send messages to connections they share with other sessions").Bool()
+	topics             = kingpin.Flag("topics", "Let clients subscribe and publish to the topics allowed by the topic-rules in the config file").Bool()
+	forwardableHeaders = kingpin.Flag("forwardable-headers", "Headers from clients' upgrade requests, such as Cookie, which they may ask to send to the servers they connect to").Strings()
+	pprofServer        = kingpin.Flag("pprof-address", "Address to host the pprof server on. This should not be exposed publicly. "+
 		"If not provided, the pprof server will not be started").String()
 
-	certFile = kingpin.Flag("tls-cert", "A PEM-encoded certificate file. Providing this enables TLS.").String()
-	keyFile  = kingpin.Flag("tls-key", "A PEM encoded private key file. Providing this enables TLS.").String()
-	caFile   = kingpin.Flag("tls-ca", "A PEM-encoded CA's cert. Providing this enabled client cert auth").String()
+	certFile          = kingpin.Flag("tls-cert", "A PEM-encoded certificate file. Providing this enables TLS.").String()
+	keyFile           = kingpin.Flag("tls-key", "A PEM encoded private key file. Providing this enables TLS.").String()
+	caFile            = kingpin.Flag("tls-ca", "A PEM-encoded CA's cert. Providing this verifies client certificates, which give clients their identities").String()
+	requireClientCert = kingpin.Flag("tls-require-client-cert", "Reject clients which don't present a certificate signed by the --tls-ca").Bool()
 
 	frameSizeLimit = kingpin.Flag("frame-size-limit", "Maximum limit, in bytes, of control or close frames from the client").Default("5MB").Bytes()
 	writeTimeout   = kingpin.Flag("write-timeout", "Write timeout for remote connections").Default("5s").Duration()
-	readTimeout    = kingpin.Flag("read-timeout", "Read timeout for remote connections").Default("5s").Duration()
+	readTimeout    = kingpin.Flag("read-timeout", "How long to wait for a response after pinging a client or remote connection").Default("5s").Duration()
 	dialTimeout    = kingpin.Flag("dial-timeout", "Dial timeout for creating remote connections").Default("10s").Duration()
+
+	pingInterval       = kingpin.Flag("ping-interval", "How often to ping remote connections, 0 to disable").Default("30s").Duration()
+	clientPingInterval = kingpin.Flag("client-ping-interval", "How often to ping clients, 0 to disable").Default("30s").Duration()
+
+	idleTimeout        = kingpin.Flag("idle-timeout", "Close remote connections with no traffic for this long, 0 to disable").Default("0s").Duration()
+	maxIdleTimeout     = kingpin.Flag("max-idle-timeout", "Maximum idle timeout clients may request for remote connections, 0 for no limit").Default("0s").Duration()
+	sessionIdleTimeout = kingpin.Flag("session-idle-timeout", "Close client sessions with no connections or control messages for this long, 0 to disable").Default("0s").Duration()
+
+	accessLogPath       = kingpin.Flag("access-log", "Where to write the JSON access log: 'stdout', 'syslog', or a file path. If not provided, no access log is written").String()
+	accessLogMaxSize    = kingpin.Flag("access-log-max-size", "Size at which the access log file is rotated").Default("100MB").Bytes()
+	accessLogMaxBackups = kingpin.Flag("access-log-max-backups", "Number of rotated access log files to keep").Default("5").Int()
+	accessLogRedact     = kingpin.Flag("access-log-redact-query", "Query string parameters to redact from URLs in the access log, or '*' for all").Strings()
+
+	adminAddress = kingpin.Flag("admin-address", "Address to host the admin API on. This should not be exposed publicly. If not provided, the admin API is disabled").String()
+	adminToken   = kingpin.Flag("admin-token", "Bearer token that requests to the admin API must provide").Envar("WSPLICE_ADMIN_TOKEN").String()
+
+	otlpEndpoint = kingpin.Flag("otlp-endpoint", "Host and port of an OTLP/HTTP collector to export traces to. If not provided, traces are not exported").String()
+	otlpInsecure = kingpin.Flag("otlp-insecure", "Export traces over plain HTTP rather than HTTPS").Bool()
+
+	configPath = kingpin.Flag("config", "YAML or TOML file to read settings from, see the readme. It's reloaded on SIGHUP or when it changes. Flags take precedence over the file").String()
+
+	connectQueueLimit = kingpin.Flag("connect-queue-limit", "Maximum number of messages queued for a connection while it's being dialed").Default("64").Int()
+	connectQueueBytes = kingpin.Flag("connect-queue-bytes", "Maximum total size of the messages queued for a connection while it's being dialed").Default("1MB").Bytes()
+	retransmitLimit   = kingpin.Flag("retransmit-limit", "Maximum number of unacknowledged messages retained for each sequenced connection").Default("256").Int()
+	retransmitBytes   = kingpin.Flag("retransmit-bytes", "Maximum total size of the unacknowledged messages retained for each sequenced connection").Default("4MB").Bytes()
+	monotonicIndices  = kingpin.Flag("monotonic-indices", "Never reuse connection indices within a session").Bool()
+	indexQuarantine   = kingpin.Flag("index-quarantine", "How long to wait before reusing the index of a closed connection").Default("0s").Duration()
+
+	readyDial      = kingpin.Flag("ready-dial", "Websocket URLs, such as a canary upstream, which must be dialable for wsplice to report that it's ready").Strings()
+	allowedOrigins = kingpin.Flag("allowed-origins", "Origins browser clients may connect from, such as 'https://example.com' or 'https://*.example.com', "+
+		"or regular expressions between slashes. If not provided, any origin may connect").Strings()
+	forwardOrigin  = kingpin.Flag("forward-origin", "Send clients' origins to the servers they connect to").Bool()
+	upstreamOrigin = kingpin.Flag("upstream-origin", "Origin to send to the servers clients connect to, instead of their own").String()
+	eventStreams   = kingpin.Flag("event-streams", "Let clients which can't open websockets start sessions with Server-Sent Events and send messages with POST requests").Bool()
+
+	shutdownTimeout = kingpin.Flag("shutdown-timeout", "How long to wait for sessions to end after a SIGTERM or SIGINT before closing them").Default("30s").Duration()
+
+	recordDir        = kingpin.Flag("record-dir", "Directory to write session recordings to, for 'wsplice replay'. If not provided, sessions aren't recorded").String()
+	recordIdentities = kingpin.Flag("record-identities", "Client certificate common names, with '*' wildcards, whose sessions are always recorded").Strings()
+	recordSampleRate = kingpin.Flag("record-sample-rate", "Fraction of other sessions to record, from 0 to 1").Default("0").Float64()
+
+	serveCommand       = kingpin.Command("serve", "Run the wsplice server. This is the default command.").Default()
+	replayCommand      = kingpin.Command("replay", "Print a session recording, or replay it against a wsplice server or with a mock upstream.")
+	replayPath         = replayCommand.Arg("recording", "The recording to replay.").Required().ExistingFile()
+	replayTo           = replayCommand.Flag("to", "URL of a wsplice server to replay the client's messages to, like ws://127.0.0.1:3000").String()
+	replayMockUpstream = replayCommand.Flag("mock-upstream", "Address to serve a mock upstream on, which sends the messages recorded from each connection in turn").String()
+	replaySpeed        = replayCommand.Flag("speed", "How many times faster than recorded to replay, or 0 to replay as fast as possible").Default("1").Float64()
 )
 
 func main() {
 	kingpin.Version(version)
-	kingpin.Parse()
+	if kingpin.Parse() == replayCommand.FullCommand() {
+		replay()
+		return
+	}
+
+	explicit, err := explicitFlags(kingpin.CommandLine, os.Args[1:])
+	if err != nil {
+		logrus.WithError(err).Fatal("Error parsing flags")
+	}
+	settings, err := loadSettings(*configPath, explicit, nil)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error loading config file")
+	}
+
+	go startPprof()
 
 	var (
-		listener net.Listener
-		err      error
+		servers    []*wsplice.Server
+		accessLog  wsplice.AccessLogger
+		tracer     *sdktrace.TracerProvider
+		listenErrs = make(chan error, len(settings.listeners))
 	)
-
-	if *certFile != "" {
-		listener, err = tls.Listen(*network, *host, createTLSConfig())
-	} else {
-		listener, err = net.Listen(*network, *host)
+	if *accessLogPath != "" {
+		accessLog = createAccessLog()
 	}
-
+	if *otlpEndpoint != "" {
+		tracer = createTracerProvider()
+	}
+	origins, err := createOriginPolicy(*allowedOrigins, *forwardOrigin, *upstreamOrigin)
 	if err != nil {
-		logrus.WithError(err).Fatal("Error creating network listener")
+		logrus.WithError(err).Fatal("Error parsing allowed origins")
+	}
+	var broker wsplice.Broker
+	if *topics {
+		broker = wsplice.NewMemoryBroker()
+	}
+	var recorder *wsplice.Recorder
+	if *recordDir != "" {
+		recorder = &wsplice.Recorder{Dir: *recordDir, Identities: *recordIdentities, SampleRate: *recordSampleRate}
+	}
+	newServer := func(config *wsplice.Config) *wsplice.Server {
+		server := &wsplice.Server{Config: config, AccessLog: accessLog, AllowedOrigins: origins, Broker: broker, Recorder: recorder, EventStreams: *eventStreams}
+		if tracer != nil {
+			server.TracerProvider = tracer
+		}
+		for _, url := range *readyDial {
+			server.ReadinessChecks = append(server.ReadinessChecks, wsplice.DialCheck("dial "+url, url))
+		}
+		servers = append(servers, server)
+		return server
 	}
 
-	go startPprof()
+	for _, listener := range settings.listeners {
+		ln, err := listen(listener)
+		if err != nil {
+			logrus.WithError(err).WithField("listen", listener.listen).Fatal("Error creating network listener")
+		}
+		if listener.raw {
+			route := listener.routes[0]
+			go serveRaw(ln, newServer(route.config), route, listenErrs)
+			continue
+		}
+		go serve(ln, createHandler(listener, newServer), listenErrs)
+	}
 
-	config := &wsplice.Config{
-		FrameSizeLimit:    int64(*frameSizeLimit),
-		WriteTimeout:      *writeTimeout,
-		ReadTimeout:       *readTimeout,
-		DialTimeout:       *dialTimeout,
-		HostnameAllowlist: *allowedHostnames,
+	for upstream := range settings.upstreams() {
+		upstream.StartHealthChecks()
+	}
+	go startAdmin(servers)
+	if *configPath != "" {
+		watcher := &configWatcher{servers: servers, path: *configPath, explicit: explicit, current: settings}
+		go watcher.watch()
 	}
 
-	logrus.Infof("wsplice listening on %s", *network)
-	err = (&http.Server{Handler: &wsplice.Server{Config: config}}).Serve(listener)
-	if err != nil {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-listenErrs:
 		logrus.WithError(err).Fatal("Error listening for http connections")
+	case sig := <-stop:
+		shutdown(servers, sig)
 	}
 }
 
-func createTLSConfig() *tls.Config {
-	cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
-	if err != nil {
-		logrus.WithError(err).Fatal("Error loading cert")
+// shutdown drains the servers, so that they're no longer ready and refuse
+// new sessions, then waits up to the shutdown timeout for their sessions
+// to end before closing them.
+func shutdown(servers []*wsplice.Server, sig os.Signal) {
+	logrus.WithField("signal", sig.String()).Info("Draining sessions before shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *wsplice.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				logrus.WithError(err).Warn("Closed sessions which were still running at the shutdown timeout")
+			}
+		}(server)
 	}
+	wg.Wait()
 
-	var certPool *x509.CertPool
-	if *caFile != "" {
-		caCert, err := ioutil.ReadFile(*caFile)
+	logrus.Info("Shut down")
+}
+
+func createAccessLog() wsplice.AccessLogger {
+	var w io.Writer
+	switch *accessLogPath {
+	case "stdout":
+		w = os.Stdout
+	case "syslog":
+		syslogWriter, err := newSyslogWriter()
+		if err != nil {
+			logrus.WithError(err).Fatal("Error connecting to syslog")
+		}
+		w = syslogWriter
+	default:
+		file, err := wsplice.OpenRotatingFile(*accessLogPath, int64(*accessLogMaxSize), *accessLogMaxBackups)
 		if err != nil {
-			log.Fatal(err)
+			logrus.WithError(err).Fatal("Error opening access log")
 		}
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(caCert)
+		w = file
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      certPool,
+	logger := wsplice.NewJSONAccessLog(w)
+	logger.RedactQuery = *accessLogRedact
+	return logger
+}
+
+func createTracerProvider() *sdktrace.TracerProvider {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(*otlpEndpoint)}
+	if *otlpInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
 	}
+
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		logrus.WithError(err).Fatal("Error creating trace exporter")
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "wsplice"),
+			attribute.String("service.version", version),
+		)),
+	)
 }
 
 func startPprof() {
@@ -6,8 +6,97 @@ type Config struct {
 	FrameSizeLimit int64
 
 	WriteTimeout time.Duration
-	ReadTimeout  time.Duration
-	DialTimeout  time.Duration
+	// ReadTimeout is how long to wait to hear back from a socket after
+	// pinging it. It's only used when pinging is enabled, and defaults to
+	// the ping interval.
+	ReadTimeout time.Duration
+	DialTimeout time.Duration
+
+	// PingInterval is how often to ping each remote server. Remote servers
+	// which don't respond within the ReadTimeout are closed with code 1006.
+	// Zero disables pinging.
+	PingInterval time.Duration
+	// ClientPingInterval is how often to ping the client. Like remote
+	// servers, clients which don't respond are disconnected.
+	ClientPingInterval time.Duration
 
 	HostnameAllowlist []string
+
+	// Upstreams are the servers clients may connect to by name, with the
+	// "target" connect parameter. They aren't subject to the
+	// HostnameAllowlist. If ForbidRawURLs is set, clients may only connect
+	// to Upstreams.
+	Upstreams     map[string]*Upstream
+	ForbidRawURLs bool
+
+	// SharedWrites lets clients send messages to connections they share
+	// with other sessions. Otherwise shared connections only receive.
+	SharedWrites bool
+
+	// TopicRules decide which topics clients may subscribe and publish to,
+	// if the server has a Broker. If there are none, no topic may be used.
+	TopicRules []TopicRule
+
+	// ForwardableHeaders are the headers from clients' upgrade requests,
+	// such as "Cookie", "Authorization" or "User-Agent", which they may ask
+	// to have sent to the remote servers they connect to, so that they
+	// needn't send secrets in their connect commands.
+	ForwardableHeaders []string
+
+	// ConnectQueueLimit is the maximum number of frames which will be queued
+	// for an asynchronous connection while it's being dialed. Defaults to 64.
+	ConnectQueueLimit int
+	// ConnectQueueBytes is the maximum total size of the frames queued for
+	// a connection while it's being dialed. Defaults to 1MB.
+	ConnectQueueBytes int64
+
+	// RetransmitLimit is the maximum number of unacknowledged messages
+	// retained for each sequenced connection. Once it's reached, the oldest
+	// can no longer be resent. Defaults to 256.
+	RetransmitLimit int
+	// RetransmitBytes is the maximum total size of the unacknowledged
+	// messages retained for each sequenced connection. Defaults to 4MB.
+	RetransmitBytes int64
+
+	// MonotonicIndices, when true, causes indices never to be reused within
+	// a session unless the client explicitly requests them. By default, new
+	// connections are given the lowest free index.
+	MonotonicIndices bool
+	// IndexQuarantine is how long an index stays unused after its connection
+	// is closed, so that late messages addressed to it aren't delivered to
+	// an unrelated connection.
+	IndexQuarantine time.Duration
+
+	// IdleTimeout is how long a connection may go without traffic in either
+	// direction before it's closed. Clients may request their own timeout,
+	// up to the MaxIdleTimeout. Zero disables the timeout.
+	IdleTimeout    time.Duration
+	MaxIdleTimeout time.Duration
+	// SessionIdleTimeout is how long a session may go without any open
+	// connections or control messages before it's closed.
+	SessionIdleTimeout time.Duration
+}
+
+// SetConfig replaces the server's configuration. New sessions, and new
+// connections made by running sessions, use the new configuration. Settings
+// which apply to a whole session, like its FrameSizeLimit, don't change for
+// sessions which are already running.
+func (s *Server) SetConfig(config *Config) {
+	s.reloaded.Store(config)
+}
+
+// currentConfig returns the configuration given to SetConfig, or the
+// server's original Config.
+func (s *Server) currentConfig() *Config {
+	if config, ok := s.reloaded.Load().(*Config); ok {
+		return config
+	}
+
+	return s.Config
+}
+
+// dialConfig returns the configuration to use for new connections, which is
+// the server's current configuration.
+func (s *Session) dialConfig() *Config {
+	return s.server.currentConfig()
 }
@@ -1,25 +1,313 @@
 package wsplice
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gobwas/ws"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// ConnectionState describes where a Connection is in its lifecycle.
+type ConnectionState int32
+
+const (
+	StateConnecting ConnectionState = iota
+	StateOpen
+	StateClosing
+)
+
+func (c ConnectionState) String() string {
+	switch c {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (c ConnectionState) MarshalJSON() ([]byte, error) { return json.Marshal(c.String()) }
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (c *ConnectionState) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+
+	for _, state := range []ConnectionState{StateConnecting, StateOpen, StateClosing} {
+		if state.String() == str {
+			*c = state
+			return nil
+		}
+	}
+
+	return fmt.Errorf("wsplice: unknown connection state %q", str)
+}
+
 type Connection struct {
-	index   int
-	session *Session
-	config  *Config
-	socket  *Socket
+	stats trafficStats
+
+	index    int
+	session  *Session
+	config   *Config
+	target   string
+	openedAt time.Time
+	state    int32
+	signaled int32
+	span     trace.Span
+
+	// readOnly is set for shared connections which clients may not send
+	// messages to.
+	readOnly bool
+	// topic is set for connections created by "subscribe". Clients may
+	// publish to it if canPublish is set.
+	topic      string
+	canPublish bool
+
+	// schema validates the messages the client sends, for connections to
+	// upstreams with a Schema.
+	schema *jsonschema.Schema
+	// sequence numbers the messages sent to the client, for sequenced
+	// connections.
+	sequence *sequencer
+
+	// sent and received collect fragmented messages in each direction,
+	// when they're validated, intercepted, sequenced or published to a
+	// topic.
+	sent     messageCollector
+	received messageCollector
+
+	// idleTimeout is how long the connection may go without any traffic
+	// before it's closed, or zero if it may be idle forever.
+	idleTimeout time.Duration
+
+	// mu guards the fields below, which change when a connecting socket
+	// is opened or closed. The url is only known once a connection to a
+	// pooled upstream is opened.
+	mu          sync.Mutex
+	url         string
+	socket      *Socket
+	shared      *sharedUpstream
+	subprotocol string
+	cancelDial  context.CancelFunc
+	pending     []pendingFrame
+	pendingSize int64
+	idleTimer   *time.Timer
+
+	// unsubscribe unsubscribes connections to topics.
+	unsubscribe func()
+	// interceptors are those registered for the connection with
+	// Session.Intercept.
+	interceptors map[Direction][]Interceptor
+}
+
+// pendingFrame is a frame the client sent to a connection while it was still
+// being dialed. The payload is kept masked, as it was read off the socket.
+type pendingFrame struct {
+	header  ws.Header
+	payload []byte
+}
+
+// newConnection creates a Connection to the remote server. It starts in the
+// StateConnecting state; open should be called once the server is dialed.
+// The connection's span is a child of the context's span, and is ended when
+// the client is notified that the connection closed.
+func newConnection(ctx context.Context, s *Session, cmd ConnectCommand) *Connection {
+	_, span := s.tracer.Start(ctx, "wsplice.connection", trace.WithAttributes(
+		attribute.String("url.full", tracedURL(cmd.URL)),
+	))
+	if cmd.Target != "" {
+		span.SetAttributes(attribute.String("wsplice.target", cmd.Target))
+	}
+
+	c := &Connection{
+		session:     s,
+		config:      s.dialConfig(),
+		url:         cmd.URL,
+		target:      cmd.Target,
+		openedAt:    time.Now(),
+		state:       int32(StateConnecting),
+		readOnly:    cmd.Shared && !s.dialConfig().SharedWrites,
+		idleTimeout: s.idleTimeout(cmd),
+		span:        span,
+	}
+	if cmd.upstream != nil {
+		c.schema = cmd.upstream.Schema
+	}
+	if cmd.Sequenced {
+		c.sequence = newSequencer(c.config)
+	}
+	c.stats.touch()
+
+	return c
+}
+
+// open attaches the dialed socket to the connection and flushes any frames
+// that were queued while it was connecting. It returns false if the
+// connection was closed in the meantime.
+func (c *Connection) open(socket *Socket, subprotocol string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.State() != StateConnecting {
+		return false
+	}
+
+	c.socket = socket
+	c.subprotocol = subprotocol
+	if conn, ok := socket.Conn.(*backendConn); ok {
+		c.url = conn.url
+	}
+	if c.cancelDial != nil {
+		c.cancelDial()
+		c.cancelDial = nil
+	}
+	for _, frame := range c.pending {
+		c.socket.WriteData(frame.header, frame.payload)
+	}
+	c.pending = nil
+	c.pendingSize = 0
+	c.setState(StateOpen)
+	c.span.AddEvent("open", trace.WithAttributes(attribute.String("wsplice.subprotocol", subprotocol)))
+
+	return true
+}
+
+// write copies a frame from the client to the remote server, or queues it if
+// the connection is still being dialed. The frame is copied without holding
+// the connection's lock, so that a slow remote server doesn't hold up Info
+// or close.
+func (c *Connection) write(header ws.Header, frame io.Reader) error {
+	if c.topic != "" {
+		return c.publish(header, frame)
+	}
+	if c.readOnly {
+		return SharedConnectionReadOnly
+	}
+
+	c.mu.Lock()
+	socket := c.socket
+	shared := c.shared != nil && c.State() == StateOpen
+	if socket == nil && !shared {
+		defer c.mu.Unlock()
+		return c.queue(header, frame)
+	}
+	c.mu.Unlock()
+
+	if shared {
+		return c.writeShared(header, frame)
+	}
+	c.stats.countSent(header.Length, header.Fin)
+	return socket.CopyData(header, frame)
+}
+
+// queue holds a frame from the client until the connection is opened.
+// Callers must hold the connection's mu.
+func (c *Connection) queue(header ws.Header, frame io.Reader) error {
+	if c.State() != StateConnecting {
+		return UnknownConnection
+	}
+	if len(c.pending) >= c.pendingLimit() || c.pendingSize+header.Length > c.pendingBytesLimit() {
+		return ConnectQueueFull
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(frame, payload); err != nil {
+		return err
+	}
+
+	c.pending = append(c.pending, pendingFrame{header, payload})
+	c.pendingSize += header.Length
+	c.stats.countSent(header.Length, header.Fin)
+
+	return nil
+}
+
+// pendingLimit returns the maximum number of frames that may be queued while
+// the connection is being dialed.
+func (c *Connection) pendingLimit() int {
+	if c.config.ConnectQueueLimit > 0 {
+		return c.config.ConnectQueueLimit
+	}
+
+	return defaultConnectQueueLimit
+}
+
+// pendingBytesLimit returns the maximum number of bytes that may be queued
+// while the connection is being dialed.
+func (c *Connection) pendingBytesLimit() int64 {
+	if c.config.ConnectQueueBytes > 0 {
+		return c.config.ConnectQueueBytes
+	}
+
+	return defaultConnectQueueBytes
+}
+
+// State returns the connection's current state.
+func (c *Connection) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+func (c *Connection) setState(state ConnectionState) {
+	atomic.StoreInt32(&c.state, int32(state))
+}
+
+// Info returns a snapshot of the connection and its traffic statistics.
+func (c *Connection) Info() ConnectionInfo {
+	c.mu.Lock()
+	url, subprotocol := c.url, c.subprotocol
+	var rtt time.Duration
+	if c.socket != nil {
+		rtt = c.socket.RTT()
+	}
+	if c.shared != nil && c.State() == StateOpen {
+		rtt = c.shared.rtt()
+	}
+	c.mu.Unlock()
+
+	return ConnectionInfo{
+		Index:            c.index,
+		URL:              url,
+		Target:           c.target,
+		Topic:            c.topic,
+		Subprotocol:      subprotocol,
+		State:            c.State(),
+		OpenedAt:         c.openedAt,
+		LastActivity:     c.stats.LastActivity(),
+		SentBytes:        atomic.LoadInt64(&c.stats.sentBytes),
+		SentMessages:     atomic.LoadInt64(&c.stats.sentMessages),
+		ReceivedBytes:    atomic.LoadInt64(&c.stats.receivedBytes),
+		ReceivedMessages: atomic.LoadInt64(&c.stats.receivedMessages),
+		RTT:              durationMillis(rtt),
+	}
 }
 
 // Start begins reading data from the connection, sending it to the Session.
 func (c *Connection) Start() {
 	defer c.socket.Close()
+	c.socket.StartPinging(c.config.PingInterval)
+	c.startIdleTimer()
 
 	for {
 		header, r, err := c.socket.ReadNextWithBody()
+		if isTimeout(err) {
+			c.signalClosed(ws.StatusAbnormalClosure, "read timeout")
+			return
+		}
 		if err != nil {
 			c.signalClosed(ws.StatusGoingAway, "")
 			return
@@ -30,7 +318,8 @@ func (c *Connection) Start() {
 			return
 		}
 
-		c.session.CopyIndexedData(c.index, header, r)
+		c.stats.countReceived(header.Length)
+		c.receive(header, r)
 	}
 }
 
@@ -44,16 +333,122 @@ func (c *Connection) readClosed(r io.Reader) {
 	c.signalClosed(ws.ParseCloseFrameData(data))
 }
 
+// signalClosed removes the connection and notifies the client that it was
+// closed. Only the first call has any effect.
 func (c *Connection) signalClosed(code ws.StatusCode, reason string) {
-	c.session.RemoveConnection(c.index)
+	if c.claimSignal() {
+		c.notifyClosed(code, reason)
+	}
+}
+
+// claimSignal returns true if the client has not yet been notified that the
+// connection closed, and ensures that nothing else will notify them.
+func (c *Connection) claimSignal() bool {
+	return atomic.CompareAndSwapInt32(&c.signaled, 0, 1)
+}
+
+// notifyClosed removes the connection and notifies the client that it was
+// closed. Callers should claimSignal first.
+func (c *Connection) notifyClosed(code ws.StatusCode, reason string) {
+	c.span.SetAttributes(attribute.Int("wsplice.index", c.index))
+	c.span.SetAttributes(closeAttributes(code, reason)...)
+	c.span.SetAttributes(statsAttributes(
+		atomic.LoadInt64(&c.stats.sentBytes),
+		atomic.LoadInt64(&c.stats.sentMessages),
+		atomic.LoadInt64(&c.stats.receivedBytes),
+		atomic.LoadInt64(&c.stats.receivedMessages),
+	)...)
+	c.span.End()
+	c.session.removeConnection(c)
 	c.session.SendMethod("onSocketClosed", SocketClosedCommand{
 		Index:  c.index,
 		Code:   int(code),
 		Reason: reason,
 	})
+	c.log(code, reason)
 }
 
+// log writes the closed connection to the session's access log.
+func (c *Connection) log(code ws.StatusCode, reason string) {
+	if c.session.accessLog == nil {
+		return
+	}
+
+	info := c.Info()
+	c.session.accessLog.LogConnection(ConnectionRecord{
+		SessionID:        c.session.id,
+		RemoteAddr:       c.session.remoteAddr,
+		Identity:         c.session.identity,
+		Index:            info.Index,
+		URL:              info.URL,
+		Target:           info.Target,
+		Topic:            info.Topic,
+		Subprotocol:      info.Subprotocol,
+		OpenedAt:         info.OpenedAt,
+		Duration:         durationMillis(time.Since(info.OpenedAt)),
+		SentBytes:        info.SentBytes,
+		SentMessages:     info.SentMessages,
+		ReceivedBytes:    info.ReceivedBytes,
+		ReceivedMessages: info.ReceivedMessages,
+		CloseCode:        int(code),
+		CloseReason:      reason,
+	})
+}
+
+// WriteFrame writes a frame to the remote server. The frame is dropped if
+// the connection hasn't been opened yet.
+func (c *Connection) WriteFrame(frame ws.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.socket != nil {
+		c.socket.WriteFrame(frame)
+	}
+	if c.shared != nil || c.topic != "" {
+		c.closeOnFrame(frame)
+	}
+}
+
+// closeOnFrame handles a frame the session sends to a connection without a
+// socket of its own, to a shared upstream or a topic. Close frames, sent
+// when the session ends, close the connection, the same way the remote
+// server's reply to them would close any other. Other frames aren't sent.
+func (c *Connection) closeOnFrame(frame ws.Frame) {
+	if frame.Header.OpCode == ws.OpClose {
+		// The session may be holding its connections' lock.
+		go c.signalClosed(ws.ParseCloseFrameData(frame.Payload))
+	}
+}
+
+// Close sends the frame to the remote server and closes the connection.
 func (c *Connection) Close(frame ws.Frame) {
-	c.socket.WriteFrame(frame)
-	c.socket.Close()
+	c.WriteFrame(frame)
+	c.close()
+}
+
+// close marks the connection as closing and shuts down its socket, or
+// cancels the dial if it's still connecting.
+func (c *Connection) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setState(StateClosing)
+	if c.cancelDial != nil {
+		c.cancelDial()
+	}
+	if c.socket != nil {
+		c.socket.Close()
+	}
+	if c.shared != nil {
+		c.shared.leave(c)
+	}
+	if c.unsubscribe != nil {
+		c.unsubscribe()
+		c.unsubscribe = nil
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	c.pending = nil
 }
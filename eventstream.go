@@ -0,0 +1,390 @@
+package wsplice
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// errEventStreamClosed is returned when writing to or sending on an event
+// stream which has closed.
+var errEventStreamClosed = errors.New("wsplice: event stream closed")
+
+// An eventStream is the Transport for a session with a client which can't
+// open websockets. Frames the session sends are written to the client as
+// Server-Sent Events, and the messages the client POSTs are read as frames.
+type eventStream struct {
+	token      string
+	remoteAddr eventStreamAddr
+
+	// messages carries the frames the client POSTs to the session, and
+	// pongs the frames answering the session's pings.
+	messages chan eventStreamMessage
+	pongs    chan []byte
+	current  []byte
+
+	deadlineMu    sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	writeMu    sync.Mutex
+	out        *bufio.Writer
+	flusher    http.Flusher
+	controller *http.ResponseController
+	index      int
+	opCode     ws.OpCode
+	message    []byte
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// eventStreamMessage is a message a client POSTed to its event stream.
+type eventStreamMessage struct {
+	opCode  ws.OpCode
+	payload []byte
+}
+
+// eventStreamAddr is the remote address of an event stream's GET request.
+type eventStreamAddr string
+
+func (a eventStreamAddr) Network() string { return "tcp" }
+func (a eventStreamAddr) String() string  { return string(a) }
+
+// isEventStreamRequest returns whether the request opens an event stream, or
+// sends a message on one with its token.
+func isEventStreamRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet:
+		return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	case http.MethodPost:
+		return r.URL.Query().Get("token") != ""
+	default:
+		return false
+	}
+}
+
+// postsToEventStream returns whether the request sends a message on an open
+// event stream.
+func (s *Server) postsToEventStream(r *http.Request) bool {
+	return s.EventStreams && r.Method == http.MethodPost && s.eventStream(r.URL.Query().Get("token")) != nil
+}
+
+// serveEventStream serves a request to open an event stream or to send a
+// message on one.
+func (s *Server) serveEventStream(w http.ResponseWriter, r *http.Request) {
+	// Browsers only let pages read the stream, and see whether their
+	// messages were taken, from origins the server names.
+	if origin := r.Header.Get("Origin"); s.AllowedOrigins.lists(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	if r.Method == http.MethodPost {
+		s.postEventStream(w, r)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	stream := &eventStream{
+		token:      uuid.NewV4().String(),
+		remoteAddr: eventStreamAddr(r.RemoteAddr),
+		messages:   make(chan eventStreamMessage),
+		pongs:      make(chan []byte, 1),
+		out:        bufio.NewWriter(w),
+		flusher:    flusher,
+		controller: http.NewResponseController(w),
+		closed:     make(chan struct{}),
+	}
+	s.addEventStream(stream)
+	defer s.removeEventStream(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	writeEvent(stream.out, "session", fmt.Sprintf(`{"token":%q}`, stream.token))
+	stream.flush()
+
+	// End the session once the client goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			stream.Close()
+		case <-done:
+		}
+	}()
+
+	ctx := s.propagator().Extract(context.Background(), propagation.HeaderCarrier(r.Header))
+	ctx = context.WithValue(ctx, upgradeKey{}, upgrade{header: r.Header, tls: r.TLS})
+	s.ServeTransport(ctx, stream)
+	// Once closed, the stream has finished writing to the response.
+	stream.Close()
+}
+
+// ReadHeader waits for the next message the client POSTs, or the pong
+// answering a ping.
+func (e *eventStream) ReadHeader() (ws.Header, error) {
+	e.deadlineMu.Lock()
+	deadline := e.readDeadline
+	e.deadlineMu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case message := <-e.messages:
+		e.current = message.payload
+		return ws.Header{Fin: true, OpCode: message.opCode, Length: int64(len(message.payload))}, nil
+	case payload := <-e.pongs:
+		e.current = payload
+		return ws.Header{Fin: true, OpCode: ws.OpPong, Length: int64(len(payload))}, nil
+	case <-timeout:
+		return ws.Header{}, os.ErrDeadlineExceeded
+	case <-e.closed:
+		return ws.Header{}, io.EOF
+	}
+}
+
+// Read reads the payload of the message last returned by ReadHeader.
+func (e *eventStream) Read(p []byte) (int, error) {
+	if len(e.current) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, e.current)
+	e.current = e.current[n:]
+	return n, nil
+}
+
+// WriteFrame writes a frame from the session to the client. Text messages
+// are sent as "text" events, and binary messages as "binary" events with
+// base64 payloads, each with the message's index before its payload. Pings
+// are answered, and sent to the client as comments to keep the stream alive.
+// Close frames are sent as a "close" event, after which the stream is
+// closed.
+func (e *eventStream) WriteFrame(header ws.Header, r io.Reader) error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	select {
+	case <-e.closed:
+		return errEventStreamClosed
+	default:
+	}
+	e.deadlineMu.Lock()
+	e.controller.SetWriteDeadline(e.writeDeadline)
+	e.deadlineMu.Unlock()
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return err
+	}
+	if header.Masked {
+		ws.Cipher(payload, header.Mask, 0)
+	}
+
+	switch header.OpCode {
+	case ws.OpPing:
+		e.out.WriteString(": ping\n\n")
+		select {
+		case e.pongs <- payload:
+		default:
+		}
+	case ws.OpPong:
+		return nil
+	case ws.OpClose:
+		code, reason := ws.ParseCloseFrameData(payload)
+		writeEvent(e.out, "close", fmt.Sprintf("%d %s", code, reason))
+		err := e.flush()
+		e.closeOnce.Do(func() { close(e.closed) })
+		return err
+	default:
+		if len(payload) >= indexBytesSize {
+			e.index = int(binary.BigEndian.Uint16(payload))
+			payload = payload[indexBytesSize:]
+		}
+		if header.OpCode != ws.OpContinuation {
+			e.opCode = header.OpCode
+			e.message = e.message[:0]
+		}
+		e.message = append(e.message, payload...)
+		if !header.Fin {
+			return nil
+		}
+		writeMessageEvent(e.out, e.index, e.opCode, e.message)
+	}
+
+	return e.flush()
+}
+
+// flush sends the events written so far to the client.
+func (e *eventStream) flush() error {
+	if err := e.out.Flush(); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+func (e *eventStream) SetReadDeadline(t time.Time) error {
+	e.deadlineMu.Lock()
+	defer e.deadlineMu.Unlock()
+	e.readDeadline = t
+	return nil
+}
+
+func (e *eventStream) SetWriteDeadline(t time.Time) error {
+	e.deadlineMu.Lock()
+	defer e.deadlineMu.Unlock()
+	e.writeDeadline = t
+	return nil
+}
+
+func (e *eventStream) RemoteAddr() net.Addr { return e.remoteAddr }
+
+// Close closes the stream, once any frame being written has been.
+func (e *eventStream) Close() error {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+	e.closeOnce.Do(func() { close(e.closed) })
+	return nil
+}
+
+// send hands a message the client POSTed to the session, waiting until it's
+// read, the stream closes or the request is cancelled.
+func (e *eventStream) send(ctx context.Context, message eventStreamMessage) error {
+	select {
+	case e.messages <- message:
+		return nil
+	case <-e.closed:
+		return errEventStreamClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeMessageEvent writes a message the session sent as an event. Text with
+// carriage returns, which clients would read as line breaks, is sent as a
+// "text-base64" event.
+func writeMessageEvent(w *bufio.Writer, index int, opCode ws.OpCode, payload []byte) {
+	prefix := strconv.Itoa(index) + " "
+	switch {
+	case opCode == ws.OpText && !strings.ContainsRune(string(payload), '\r'):
+		writeEvent(w, "text", prefix+string(payload))
+	case opCode == ws.OpText:
+		writeEvent(w, "text-base64", prefix+base64.StdEncoding.EncodeToString(payload))
+	default:
+		writeEvent(w, "binary", prefix+base64.StdEncoding.EncodeToString(payload))
+	}
+}
+
+// writeEvent writes an event, with a "data" line for each line of the data.
+func writeEvent(w *bufio.Writer, event, data string) {
+	w.WriteString("event: " + event + "\n")
+	for _, line := range strings.Split(data, "\n") {
+		w.WriteString("data: " + line + "\n")
+	}
+	w.WriteString("\n")
+}
+
+// postEventStream sends the body of a POST request to the session of the
+// event stream with the request's token, as a message on the index in its
+// query. Its "type" is "text", the default, or "binary" for base64 bodies.
+func (s *Server) postEventStream(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	stream := s.eventStream(query.Get("token"))
+	if stream == nil {
+		http.Error(w, "unknown event stream", http.StatusNotFound)
+		return
+	}
+	index, err := strconv.ParseUint(query.Get("index"), 10, 16)
+	if err != nil {
+		http.Error(w, "invalid index", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.currentConfig().FrameSizeLimit+1))
+	if err != nil {
+		http.Error(w, "error reading body", http.StatusBadRequest)
+		return
+	}
+	opCode := ws.OpCode(ws.OpText)
+	switch query.Get("type") {
+	case "", "text":
+	case "binary":
+		opCode = ws.OpBinary
+		if body, err = base64.StdEncoding.DecodeString(string(body)); err != nil {
+			http.Error(w, "invalid base64 body", http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "invalid type", http.StatusBadRequest)
+		return
+	}
+	if int64(len(body)) > s.currentConfig().FrameSizeLimit {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	payload := make([]byte, indexBytesSize+len(body))
+	binary.BigEndian.PutUint16(payload, uint16(index))
+	copy(payload[indexBytesSize:], body)
+	if err := stream.send(r.Context(), eventStreamMessage{opCode: opCode, payload: payload}); err != nil {
+		logrus.WithError(err).Debug("Error sending a message to an event stream's session")
+		http.Error(w, "unknown event stream", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) addEventStream(stream *eventStream) {
+	s.eventStreamsMu.Lock()
+	defer s.eventStreamsMu.Unlock()
+
+	if s.eventStreams == nil {
+		s.eventStreams = map[string]*eventStream{}
+	}
+	s.eventStreams[stream.token] = stream
+}
+
+func (s *Server) removeEventStream(stream *eventStream) {
+	s.eventStreamsMu.Lock()
+	defer s.eventStreamsMu.Unlock()
+	delete(s.eventStreams, stream.token)
+}
+
+// eventStream returns the open event stream with the token, or nil.
+func (s *Server) eventStream(token string) *eventStream {
+	s.eventStreamsMu.Lock()
+	defer s.eventStreamsMu.Unlock()
+	return s.eventStreams[token]
+}
@@ -0,0 +1,166 @@
+package wsplice
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the next event from an event stream, skipping comments.
+func (e *EndToEndSuite) readEvent(r *bufio.Reader) (event, data string) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		e.expectNoerr(err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return event, strings.Join(lines, "\n")
+		case strings.HasPrefix(line, "event: "):
+			event = line[len("event: "):]
+		case strings.HasPrefix(line, "data: "):
+			lines = append(lines, line[len("data: "):])
+		}
+	}
+}
+
+func (e *EndToEndSuite) postEvent(token, index, kind, body string) int {
+	res, err := http.Post(e.wspliceServer.URL+"?token="+token+"&index="+index+"&type="+kind, "text/plain", strings.NewReader(body))
+	e.expectNoerr(err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func (e *EndToEndSuite) TestServesEventStreams() {
+	e.server.EventStreams = true
+	url := e.makeServer(forever(echo))
+
+	req, _ := http.NewRequest(http.MethodGet, e.wspliceServer.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	e.expectNoerr(err)
+	defer res.Body.Close()
+	require.Equal(e.T(), "text/event-stream", res.Header.Get("Content-Type"))
+	events := bufio.NewReader(res.Body)
+
+	event, data := e.readEvent(events)
+	require.Equal(e.T(), "session", event)
+	var session struct{ Token string }
+	e.expectNoerr(json.Unmarshal([]byte(data), &session))
+
+	require.Equal(e.T(), http.StatusNoContent, e.postEvent(session.Token, "65535", "text",
+		`{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`))
+	event, data = e.readEvent(events)
+	require.Equal(e.T(), "text", event)
+	require.Equal(e.T(), `65535 {"id":1,"type":"reply","result":{"index":0}}`, data)
+
+	require.Equal(e.T(), http.StatusNoContent, e.postEvent(session.Token, "0", "text", "hello\nworld"))
+	event, data = e.readEvent(events)
+	require.Equal(e.T(), "text", event)
+	require.Equal(e.T(), "0 hello\nworld", data)
+
+	require.Equal(e.T(), http.StatusNoContent, e.postEvent(session.Token, "0", "binary", "AAEC"))
+	event, data = e.readEvent(events)
+	require.Equal(e.T(), "binary", event)
+	require.Equal(e.T(), "0 AAEC", data)
+
+	require.Equal(e.T(), http.StatusNotFound, e.postEvent("nope", "0", "text", "hello"))
+	require.Equal(e.T(), http.StatusBadRequest, e.postEvent(session.Token, "65536", "text", "hello"))
+	require.Equal(e.T(), http.StatusBadRequest, e.postEvent(session.Token, "0", "binary", "!"))
+
+	require.Len(e.T(), e.server.Sessions(), 1)
+	res.Body.Close()
+	require.Eventually(e.T(), func() bool { return len(e.server.Sessions()) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func (e *EndToEndSuite) TestRequiresEnablingEventStreams() {
+	req, _ := http.NewRequest(http.MethodGet, e.wspliceServer.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	e.expectNoerr(err)
+	res.Body.Close()
+	require.Equal(e.T(), http.StatusBadRequest, res.StatusCode)
+}
+
+func (e *EndToEndSuite) TestKeepsEventStreamsAlive() {
+	e.server.EventStreams = true
+	e.config.ClientPingInterval = 10 * time.Millisecond
+	e.config.ReadTimeout = 20 * time.Millisecond
+
+	req, _ := http.NewRequest(http.MethodGet, e.wspliceServer.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	e.expectNoerr(err)
+	defer res.Body.Close()
+	events := bufio.NewReader(res.Body)
+	event, _ := e.readEvent(events)
+	require.Equal(e.T(), "session", event)
+
+	// The stream answers the session's pings, so it outlives the timeout.
+	time.Sleep(200 * time.Millisecond)
+	require.Len(e.T(), e.server.Sessions(), 1)
+	line, err := events.ReadString('\n')
+	e.expectNoerr(err)
+	require.Equal(e.T(), ": ping\n", line)
+}
+
+func (e *EndToEndSuite) TestTakesEventStreamMessagesWhileDraining() {
+	e.server.EventStreams = true
+	url := e.makeServer(forever(echo))
+
+	req, _ := http.NewRequest(http.MethodGet, e.wspliceServer.URL, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	e.expectNoerr(err)
+	defer res.Body.Close()
+	events := bufio.NewReader(res.Body)
+	_, data := e.readEvent(events)
+	var session struct{ Token string }
+	e.expectNoerr(json.Unmarshal([]byte(data), &session))
+
+	e.server.Drain()
+	require.Equal(e.T(), http.StatusNoContent, e.postEvent(session.Token, "65535", "text",
+		`{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`))
+	event, data := e.readEvent(events)
+	require.Equal(e.T(), "text", event)
+	require.Equal(e.T(), `65535 {"id":1,"type":"reply","result":{"index":0}}`, data)
+
+	require.Equal(e.T(), http.StatusServiceUnavailable, e.postEvent("nope", "0", "text", "hello"))
+	res, err = http.DefaultClient.Do(req)
+	e.expectNoerr(err)
+	res.Body.Close()
+	require.Equal(e.T(), http.StatusServiceUnavailable, res.StatusCode)
+}
+
+func (e *EndToEndSuite) TestOnlyAllowsListedOriginsToReadEventStreams() {
+	e.server.EventStreams = true
+	open := func(origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, e.wspliceServer.URL, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Origin", origin)
+		res, err := http.DefaultClient.Do(req)
+		e.expectNoerr(err)
+		res.Body.Close()
+		return res
+	}
+
+	require.Equal(e.T(), "", open("https://example.com").Header.Get("Access-Control-Allow-Origin"))
+
+	e.server.AllowedOrigins = &OriginPolicy{Origins: []string{"https://example.com"}}
+	require.Equal(e.T(), "https://example.com", open("https://example.com").Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(e.T(), http.StatusForbidden, open("https://other.example.com").StatusCode)
+}
+
+func (e *EndToEndSuite) TestOnlyTakesEventStreamMessagesWithTokens() {
+	e.server.EventStreams = true
+
+	res, err := http.Post(e.wspliceServer.URL+"?index=0", "text/plain", strings.NewReader("hello"))
+	e.expectNoerr(err)
+	res.Body.Close()
+	require.Equal(e.T(), http.StatusBadRequest, res.StatusCode)
+	require.Equal(e.T(), http.StatusNotFound, e.postEvent("nope", "0", "text", "hello"))
+}
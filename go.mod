@@ -0,0 +1,27 @@
+module github.com/mixer/wsplice
+
+go 1.21
+
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/gobwas/httphead v0.0.0-20170717154033-d8ef83dd38ef
+	github.com/gobwas/pool v0.0.0-20170829094749-32dbaa12caca
+	github.com/gobwas/ws v0.0.0-20170813201807-e76b8ddad654
+	github.com/gorilla/websocket v1.5.3
+	github.com/mixer/go-ext v0.0.0-20170915014333-5ae263f83752
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	github.com/satori/go.uuid v1.1.1-0.20170321230731-5bf94b69c6b6
+	github.com/sirupsen/logrus v1.9.3
+	github.com/stretchr/testify v1.9.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	gopkg.in/alecthomas/kingpin.v2 v2.2.5
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
+	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
+)
@@ -0,0 +1,205 @@
+package wsplice
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// A Handler serves connections to URLs registered with Server.Handle in the
+// same process, instead of wsplice dialing a remote server. It's called in
+// its own goroutine for each connection, which is closed when it returns.
+type Handler func(stream *Stream)
+
+// Handle registers the handler to serve connections to the name, which is
+// either a URL without a query string, like "internal://metrics-feed", or a
+// scheme like "internal" for every URL with it. URLs are matched exactly
+// before their scheme. Connections to handlers aren't subject to the
+// HostnameAllowlist.
+func (s *Server) Handle(name string, handler Handler) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+
+	if s.handlers == nil {
+		s.handlers = map[string]Handler{}
+	}
+	s.handlers[name] = handler
+}
+
+// handler returns the Handler registered for the URL, if any.
+func (s *Server) handler(rawURL string) Handler {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Scheme == "" {
+		return nil
+	}
+
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+	if handler := s.handlers[parsed.Scheme+"://"+parsed.Host+parsed.Path]; handler != nil {
+		return handler
+	}
+
+	return s.handlers[parsed.Scheme]
+}
+
+// Stream is a Handler's side of a connection. Messages the client sends are
+// read from it, and messages written to it are sent to the client.
+//
+// Messages are read in the background, up to the ConnectQueueLimit ahead
+// of the handler. Handlers which stop reading stop answering pings too, so
+// they should keep reading until the stream is done; messages still queued
+// once the stream is closed are dropped.
+//
+// The connection's side is an ordinary websocket over a net.Pipe, so
+// messages are still framed and unframed in memory on their way through.
+// Fragmented messages are put back together up to the FrameSizeLimit; the
+// stream is closed with StatusMessageTooBig if the client sends more.
+type Stream struct {
+	// URL is the URL the client connected to, including its query string.
+	URL string
+	// Header holds the headers the client asked to send.
+	Header http.Header
+
+	conn         net.Conn
+	writeTimeout time.Duration
+	sizeLimit    int64
+	messages     chan streamMessage
+	closed       chan struct{}
+	done         chan struct{}
+	writeMu      sync.Mutex
+	closeOnce    sync.Once
+}
+
+type streamMessage struct {
+	opCode  ws.OpCode
+	payload []byte
+}
+
+// dialHandler starts the handler on one end of an in-memory pipe, and
+// returns the other for the connection to use in place of a dialed socket.
+func (s *Session) dialHandler(handler Handler, rawURL string, header http.Header) net.Conn {
+	client, server := net.Pipe()
+	config := s.dialConfig()
+	limit := config.ConnectQueueLimit
+	if limit <= 0 {
+		limit = defaultConnectQueueLimit
+	}
+
+	stream := &Stream{
+		URL:          rawURL,
+		Header:       header,
+		conn:         server,
+		writeTimeout: config.WriteTimeout,
+		sizeLimit:    config.FrameSizeLimit,
+		messages:     make(chan streamMessage, limit),
+		closed:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go stream.read()
+	go func() {
+		defer stream.Close()
+		handler(stream)
+	}()
+
+	return client
+}
+
+// read reads frames from the connection until it's closed, answering pings
+// and queueing messages for ReadMessage.
+func (s *Stream) read() {
+	defer close(s.done)
+	defer close(s.messages)
+
+	var message streamMessage
+	for {
+		header, err := ws.ReadHeader(s.conn)
+		if err != nil {
+			return
+		}
+		if int64(len(message.payload))+header.Length > s.sizeLimit {
+			s.CloseWithStatus(ws.StatusMessageTooBig, "")
+			return
+		}
+		frame := ws.Frame{Header: header, Payload: make([]byte, header.Length)}
+		if _, err := io.ReadFull(s.conn, frame.Payload); err != nil {
+			return
+		}
+		if frame.Header.Masked {
+			ws.Cipher(frame.Payload, frame.Header.Mask, 0)
+		}
+
+		switch frame.Header.OpCode {
+		case ws.OpPing:
+			s.writeFrame(ws.NewPongFrame(frame.Payload))
+		case ws.OpPong:
+		case ws.OpClose:
+			s.CloseWithStatus(ws.ParseCloseFrameData(frame.Payload))
+			return
+		default:
+			if frame.Header.OpCode != ws.OpContinuation {
+				message = streamMessage{opCode: frame.Header.OpCode}
+			}
+			message.payload = append(message.payload, frame.Payload...)
+			if frame.Header.Fin {
+				select {
+				case s.messages <- message:
+				case <-s.closed:
+					return
+				}
+				message = streamMessage{}
+			}
+		}
+	}
+}
+
+// ReadMessage returns the next message the client sent. It returns io.EOF
+// once the stream is closed.
+func (s *Stream) ReadMessage() (ws.OpCode, []byte, error) {
+	message, ok := <-s.messages
+	if !ok {
+		return 0, nil, io.EOF
+	}
+
+	return message.opCode, message.payload, nil
+}
+
+// WriteMessage sends a message to the client.
+func (s *Stream) WriteMessage(opCode ws.OpCode, payload []byte) error {
+	return s.writeFrame(ws.NewFrame(opCode, true, payload))
+}
+
+func (s *Stream) writeFrame(frame ws.Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.writeTimeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+	}
+	return ws.WriteFrame(s.conn, frame)
+}
+
+// Done returns a channel which is closed once the stream is closed, by
+// either side.
+func (s *Stream) Done() <-chan struct{} { return s.done }
+
+// Close closes the stream with a normal closure status.
+func (s *Stream) Close() error {
+	return s.CloseWithStatus(ws.StatusNormalClosure, "")
+}
+
+// CloseWithStatus closes the stream, notifying the client with the code and
+// reason.
+func (s *Stream) CloseWithStatus(code ws.StatusCode, reason string) (err error) {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.writeFrame(ws.NewCloseFrame(code, reason))
+		err = s.conn.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,111 @@
+package wsplice
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/stretchr/testify/require"
+)
+
+func (e *EndToEndSuite) TestServesHandlers() {
+	e.server.Handle("internal://echo", func(stream *Stream) {
+		for {
+			opCode, payload, err := stream.ReadMessage()
+			if err != nil {
+				return
+			}
+			stream.WriteMessage(opCode, payload)
+		}
+	})
+	e.server.Handle("internal", func(stream *Stream) {
+		stream.WriteMessage(ws.OpText, []byte(`"`+stream.URL+` `+stream.Header.Get("X-Token")+`"`))
+		stream.CloseWithStatus(4321, "done")
+	})
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"internal://echo?room=5"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"connect","params":{"url":"internal://other","headers":{"X-Token":"secret"}}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","result":{"index":1}}`)
+	e.expectRead(cnx, 1, `"internal://other secret"`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":4321,"reason":"done","index":1}}`)
+
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"url":"unknown://echo"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","error":{"code":4007,"message":"You are not allowd to connect to that hostname","path":"url"}}`)
+}
+
+func (e *EndToEndSuite) TestClosesHandlerStreams() {
+	done := make(chan struct{})
+	e.server.Handle("internal://feed", func(stream *Stream) {
+		<-stream.Done()
+		close(done)
+	})
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"internal://feed"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","result":{}}`)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.Fail(e.T(), "expected the handler's stream to be done")
+	}
+}
+
+func (e *EndToEndSuite) TestLimitsHandlerMessages() {
+	e.server.Handle("internal://sink", func(stream *Stream) {
+		for {
+			if _, _, err := stream.ReadMessage(); err != nil {
+				return
+			}
+		}
+	})
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"internal://sink"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+
+	// Gorilla fragments messages, so each frame is under the limit but the
+	// message isn't.
+	e.write(cnx, 0, `"`+strings.Repeat("a", 600*1024)+`"`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1009,"reason":"","index":0}}`)
+}
+
+func (e *EndToEndSuite) TestClosesHandlersWhichNeverRead() {
+	streams := make(chan *Stream, 1)
+	release := make(chan struct{})
+	e.server.Handle("internal://feed", func(stream *Stream) {
+		streams <- stream
+		stream.WriteMessage(ws.OpText, []byte(`"hello"`))
+		<-release
+	})
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"internal://feed"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.expectRead(cnx, 0, `"hello"`)
+	for i := 0; i < defaultConnectQueueLimit+10; i++ {
+		e.write(cnx, 0, `"ignored"`)
+	}
+
+	stream := <-streams
+	require.Eventually(e.T(), func() bool {
+		return len(stream.messages) == cap(stream.messages)
+	}, time.Second, 10*time.Millisecond)
+	close(release)
+	select {
+	case <-stream.Done():
+	case <-time.After(time.Second):
+		require.Fail(e.T(), "expected the stream to be done once the handler returned")
+	}
+}
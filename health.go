@@ -0,0 +1,162 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// readinessTimeout is how long the readiness handler waits for checks
+	// to finish before failing them.
+	readinessTimeout = 5 * time.Second
+	// shutdownPollInterval is how often Shutdown checks whether all
+	// sessions have ended.
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
+// ErrDraining is reported by the "draining" readiness check once the
+// server has started to drain.
+var ErrDraining = errors.New("server is draining")
+
+// A ReadinessCheck is a dependency which must be healthy for the server to
+// take new sessions.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// DialCheck returns a ReadinessCheck which dials the websocket URL, such as
+// a canary upstream, and closes it again.
+func DialCheck(name, url string) ReadinessCheck {
+	return ReadinessCheck{
+		Name: name,
+		Check: func(ctx context.Context) error {
+			conn, _, err := ws.Dialer{}.Dial(ctx, url, nil)
+			if err != nil {
+				return err
+			}
+
+			return conn.Close()
+		},
+	}
+}
+
+// Readiness is the result of a server's readiness checks. Checks maps
+// each check's name to "ok", or to the error it failed with.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Readiness runs the server's readiness checks. The server isn't ready
+// while it's draining, or if any of its ReadinessChecks fail.
+func (s *Server) Readiness(ctx context.Context) Readiness {
+	readiness := Readiness{Ready: true, Checks: map[string]string{"draining": "ok"}}
+	if s.Draining() {
+		readiness.Ready = false
+		readiness.Checks["draining"] = ErrDraining.Error()
+	}
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, check := range s.ReadinessChecks {
+		wg.Add(1)
+		go func(check ReadinessCheck) {
+			defer wg.Done()
+			err := check.Check(ctx)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				readiness.Ready = false
+				readiness.Checks[check.Name] = err.Error()
+			} else {
+				readiness.Checks[check.Name] = "ok"
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return readiness
+}
+
+// ReadinessHandler returns an HTTP handler which responds with the server's
+// Readiness as JSON, with a 503 status if it isn't ready.
+func (s *Server) ReadinessHandler() http.Handler {
+	return CombinedReadinessHandler(s)
+}
+
+// CombinedReadinessHandler is like Server.ReadinessHandler, but it's only
+// ready if all of the servers are. It's useful when serving several
+// servers from one HTTP listener.
+func CombinedReadinessHandler(servers ...*Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		combined := Readiness{Ready: true, Checks: map[string]string{}}
+		for _, server := range servers {
+			readiness := server.Readiness(ctx)
+			combined.Ready = combined.Ready && readiness.Ready
+			for name, result := range readiness.Checks {
+				if existing, ok := combined.Checks[name]; !ok || existing == "ok" {
+					combined.Checks[name] = result
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if combined.Ready {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(combined)
+	})
+}
+
+// Drain stops the server from taking new sessions; ServeHTTP responds to
+// new clients with a 503 status, and the server is no longer ready.
+// Running sessions are left alone.
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+// Draining returns whether Drain or Shutdown has been called.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Shutdown drains the server and waits for its sessions to end. If the
+// context is done first, the sessions left are closed with a "going away"
+// status and the context's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Drain()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if len(s.Sessions()) == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, session := range s.Sessions() {
+				session.CloseWithReason(ws.StatusGoingAway, "server shutting down")
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
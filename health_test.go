@@ -0,0 +1,75 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func (e *EndToEndSuite) readiness() (int, Readiness) {
+	rec := httptest.NewRecorder()
+	e.server.ReadinessHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+	var readiness Readiness
+	require.Nil(e.T(), json.Unmarshal(rec.Body.Bytes(), &readiness))
+	return rec.Code, readiness
+}
+
+func (e *EndToEndSuite) TestReportsReadiness() {
+	e.server.ReadinessChecks = []ReadinessCheck{
+		DialCheck("canary", e.makeServer(echo)),
+		DialCheck("missing", "ws://127.0.0.1:1"),
+	}
+	status, readiness := e.readiness()
+	require.Equal(e.T(), http.StatusServiceUnavailable, status)
+	require.False(e.T(), readiness.Ready)
+	require.Equal(e.T(), "ok", readiness.Checks["draining"])
+	require.Equal(e.T(), "ok", readiness.Checks["canary"])
+	require.NotEqual(e.T(), "ok", readiness.Checks["missing"])
+
+	e.server.ReadinessChecks = e.server.ReadinessChecks[:1]
+	status, readiness = e.readiness()
+	require.Equal(e.T(), http.StatusOK, status)
+	require.True(e.T(), readiness.Ready)
+}
+
+func (e *EndToEndSuite) TestDrains() {
+	cnx := e.connectSocket()
+	e.waitForSessions(1)
+
+	e.server.Drain()
+	status, readiness := e.readiness()
+	require.Equal(e.T(), http.StatusServiceUnavailable, status)
+	require.Equal(e.T(), ErrDraining.Error(), readiness.Checks["draining"])
+
+	_, res, err := websocket.DefaultDialer.Dial("ws:"+e.wspliceServer.URL[5:], nil)
+	require.NotNil(e.T(), err)
+	require.Equal(e.T(), http.StatusServiceUnavailable, res.StatusCode)
+
+	// Sessions which were already running carry on.
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"listConnections"}`)
+	var reply struct {
+		Result ListConnectionsResponse `json:"result"`
+	}
+	e.readJSON(cnx, 0xffff, &reply)
+	require.Empty(e.T(), reply.Result.Connections)
+}
+
+func (e *EndToEndSuite) TestShutsDown() {
+	cnx := e.connectSocket()
+	e.waitForSessions(1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(e.T(), context.DeadlineExceeded, e.server.Shutdown(ctx))
+
+	_, _, err := cnx.ReadMessage()
+	require.Equal(e.T(), &websocket.CloseError{Code: 1001, Text: "server shutting down"}, err)
+	e.waitForSessions(0)
+	require.Nil(e.T(), e.server.Shutdown(context.Background()))
+}
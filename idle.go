@@ -0,0 +1,110 @@
+package wsplice
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// idleReason is the close reason given to sockets closed for being idle.
+const idleReason = "idle"
+
+// idleTimeout returns how long a connection made with the command may go
+// without traffic before it's closed. Clients may ask for their own timeout,
+// up to a maximum of the configured MaxIdleTimeout.
+func (s *Session) idleTimeout(cmd ConnectCommand) time.Duration {
+	config := s.dialConfig()
+	timeout := config.IdleTimeout
+	if cmd.IdleTimeout > 0 {
+		timeout = time.Millisecond * time.Duration(cmd.IdleTimeout)
+	}
+	if config.MaxIdleTimeout > 0 && (timeout == 0 || timeout > config.MaxIdleTimeout) {
+		timeout = config.MaxIdleTimeout
+	}
+
+	return timeout
+}
+
+// startIdleTimer starts closing the connection once it's gone its
+// idleTimeout without any traffic.
+func (c *Connection) startIdleTimer() {
+	if c.idleTimeout <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.idleTimer = time.AfterFunc(c.idleTimeout, c.checkIdle)
+	c.mu.Unlock()
+}
+
+// checkIdle closes the connection if it's been idle for its idleTimeout,
+// otherwise it checks again when it would next become idle.
+func (c *Connection) checkIdle() {
+	idle := time.Since(c.stats.LastActivity())
+	if idle < c.idleTimeout {
+		c.mu.Lock()
+		if c.idleTimer != nil {
+			c.idleTimer.Reset(c.idleTimeout - idle)
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	// Claim the notification before closing the socket, otherwise the
+	// reader would report it as having disconnected without a reason.
+	if c.claimSignal() {
+		c.Close(ws.NewCloseFrame(ws.StatusNormalClosure, idleReason))
+		c.notifyClosed(ws.StatusNormalClosure, idleReason)
+	}
+}
+
+// touch records control traffic on the session, resetting its idle time.
+func (s *Session) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// startIdleTimer starts closing the session once it's gone the configured
+// SessionIdleTimeout without any connections or control traffic.
+func (s *Session) startIdleTimer() {
+	if s.config.SessionIdleTimeout <= 0 {
+		return
+	}
+
+	s.touch()
+	s.connectionsMu.Lock()
+	s.idleTimer = time.AfterFunc(s.config.SessionIdleTimeout, s.checkIdle)
+	s.connectionsMu.Unlock()
+}
+
+// stopIdleTimer stops the session's idle timer, if it's running.
+func (s *Session) stopIdleTimer() {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+}
+
+// checkIdle closes the session if it's idle, otherwise it checks again when
+// the session would next become idle.
+func (s *Session) checkIdle() {
+	timeout := s.config.SessionIdleTimeout
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastActivity)))
+
+	s.connectionsMu.Lock()
+	if s.countConnections() > 0 {
+		s.idleTimer.Reset(timeout)
+		s.connectionsMu.Unlock()
+		return
+	}
+	if idle < timeout {
+		s.idleTimer.Reset(timeout - idle)
+		s.connectionsMu.Unlock()
+		return
+	}
+	s.connectionsMu.Unlock()
+
+	s.closeAll(ws.StatusNormalClosure, idleReason)
+}
@@ -0,0 +1,113 @@
+package wsplice
+
+import "time"
+
+// indexAvailable returns whether a new connection may be inserted at the
+// index. An index is unavailable if it's in use, or if it was freed less
+// than Config.IndexQuarantine ago. connectionsMu must be held.
+func (s *Session) indexAvailable(index int) bool {
+	if s.connections[index] != nil {
+		return false
+	}
+
+	freedAt, ok := s.freedIndices[index]
+	if !ok {
+		return true
+	}
+	if time.Since(freedAt) < s.config.IndexQuarantine {
+		return false
+	}
+
+	delete(s.freedIndices, index)
+	return true
+}
+
+// IndexAvailable returns whether a new connection may be inserted at the
+// index.
+func (s *Session) IndexAvailable(index int) bool {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+
+	return index >= 0 && index < controlIndex && s.indexAvailable(index)
+}
+
+// allocateIndex picks the index for a new connection. If requested is not
+// nil, the client asked for that specific index. Otherwise, the lowest
+// available index is used, or the lowest index never handed out before if
+// Config.MonotonicIndices is set. connectionsMu must be held.
+func (s *Session) allocateIndex(requested *int) (int, error) {
+	if requested != nil {
+		index := *requested
+		if index < 0 || index >= controlIndex {
+			return 0, InvalidIndex.WithPath("index")
+		}
+		if !s.indexAvailable(index) {
+			return 0, IndexInUse.WithPath("index")
+		}
+
+		s.markAllocated(index)
+		return index, nil
+	}
+
+	start := 0
+	if s.config.MonotonicIndices {
+		start = s.nextIndex
+	}
+
+	for index := start; index < controlIndex; index++ {
+		if s.indexAvailable(index) {
+			s.markAllocated(index)
+			return index, nil
+		}
+	}
+
+	return 0, IndexesExhausted.ResponseError()
+}
+
+// markAllocated records that the index has been handed out, so that it's not
+// handed out again when using monotonic allocation.
+func (s *Session) markAllocated(index int) {
+	if index >= s.nextIndex {
+		s.nextIndex = index + 1
+	}
+}
+
+// freeIndex removes the connection at the index and starts its quarantine.
+// connectionsMu must be held.
+func (s *Session) freeIndex(index int) {
+	delete(s.connections, index)
+	s.touch()
+	if s.config.IndexQuarantine <= 0 {
+		return
+	}
+
+	// Indices aren't looked up again once they're passed over by monotonic
+	// allocation, unless clients ask for them, so those whose quarantine
+	// has ended are pruned whenever the number freed has doubled.
+	now := time.Now()
+	if len(s.freedIndices) >= 2*s.prunedIndices {
+		for freed, freedAt := range s.freedIndices {
+			if now.Sub(freedAt) >= s.config.IndexQuarantine {
+				delete(s.freedIndices, freed)
+			}
+		}
+		s.prunedIndices = len(s.freedIndices)
+	}
+	s.freedIndices[index] = now
+}
+
+// insertConnection adds the Connection into the connection list and returns
+// the index it was inserted it. The client may request a specific index.
+func (s *Session) insertConnection(cnx *Connection, requested *int) (index int, err error) {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+
+	index, err = s.allocateIndex(requested)
+	if err != nil {
+		return 0, err
+	}
+
+	cnx.index = index
+	s.connections[index] = cnx
+	return index, nil
+}
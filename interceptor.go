@@ -0,0 +1,259 @@
+package wsplice
+
+import (
+	"bytes"
+	"io"
+	"sync"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+// Direction is the way messages flow through a connection.
+type Direction int
+
+const (
+	// ClientToRemote messages are sent by the client to the remote server.
+	ClientToRemote Direction = iota
+	// RemoteToClient messages are sent by the remote server to the client.
+	RemoteToClient
+)
+
+func (d Direction) String() string {
+	if d == ClientToRemote {
+		return "client-to-remote"
+	}
+
+	return "remote-to-client"
+}
+
+// An InterceptedMessage is a whole message going through a connection.
+// Fragmented messages are put back together before they're intercepted.
+type InterceptedMessage struct {
+	OpCode  ws.OpCode
+	Payload []byte
+}
+
+// Interception describes the connection an Interceptor is called for.
+type Interception struct {
+	Session   *Session
+	Index     int
+	Direction Direction
+	// URL, Target and Topic are those of the connection; see ConnectionInfo.
+	URL    string
+	Target string
+	Topic  string
+}
+
+// An Interceptor is called with each message going through a connection in
+// the direction it was registered for, and returns the messages to send on
+// in its place. It may return the message as it was or rewritten, none to
+// drop it, or several to inject others alongside it. Interceptors are
+// called in the order they were registered, each with the messages the one
+// before returned.
+//
+// If it returns an error, the message is dropped. ErrorCodes are reported
+// to the client with a "warn" call, and other errors are logged.
+type Interceptor func(in Interception, msg InterceptedMessage) ([]InterceptedMessage, error)
+
+// Intercept registers the interceptor for messages going in the direction
+// through every connection. Connections without any interceptors copy
+// frames straight through without buffering them.
+func (s *Server) Intercept(direction Direction, interceptor Interceptor) {
+	s.interceptorsMu.Lock()
+	defer s.interceptorsMu.Unlock()
+
+	if s.interceptors == nil {
+		s.interceptors = map[Direction][]Interceptor{}
+	}
+	s.interceptors[direction] = append(s.interceptors[direction], interceptor)
+}
+
+// Intercept registers the interceptor for messages going in the direction
+// through the session's connection at the index, after the Server's own,
+// until that connection is closed.
+func (s *Session) Intercept(index int, direction Direction, interceptor Interceptor) error {
+	cnx := s.GetConnection(index)
+	if cnx == nil {
+		return UnknownConnection
+	}
+
+	cnx.mu.Lock()
+	defer cnx.mu.Unlock()
+	if cnx.interceptors == nil {
+		cnx.interceptors = map[Direction][]Interceptor{}
+	}
+	cnx.interceptors[direction] = append(cnx.interceptors[direction], interceptor)
+
+	return nil
+}
+
+// interceptorsFor returns the interceptors for messages going in the
+// direction through the connection.
+func (c *Connection) interceptorsFor(direction Direction) []Interceptor {
+	server := c.session.server
+	server.interceptorsMu.RLock()
+	interceptors := server.interceptors[direction]
+	server.interceptorsMu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.interceptors[direction]) == 0 {
+		return interceptors
+	}
+
+	return append(interceptors[:len(interceptors):len(interceptors)], c.interceptors[direction]...)
+}
+
+// intercept runs the message through the interceptors, returning the
+// messages to send on.
+func (c *Connection) intercept(direction Direction, interceptors []Interceptor, msg InterceptedMessage) ([]InterceptedMessage, error) {
+	info := c.Info()
+	in := Interception{
+		Session:   c.session,
+		Index:     c.index,
+		Direction: direction,
+		URL:       info.URL,
+		Target:    info.Target,
+		Topic:     info.Topic,
+	}
+
+	messages := []InterceptedMessage{msg}
+	for _, interceptor := range interceptors {
+		var next []InterceptedMessage
+		for _, msg := range messages {
+			out, err := interceptor(in, msg)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		messages = next
+	}
+
+	return messages, nil
+}
+
+// reportInterceptError handles an error from an interceptor.
+func (c *Connection) reportInterceptError(direction Direction, err error) {
+	if code, ok := err.(ErrorCode); ok {
+		c.session.issueWarning(code)
+		return
+	}
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"id":        c.session.id,
+		"index":     c.index,
+		"direction": direction.String(),
+	}).Warn("Dropped a message an interceptor failed on")
+}
+
+// Write copies a frame from the client to the remote server, or queues it if
+// the connection is still being dialed. If there are interceptors or a
+// schema, whole messages are collected, validated and run through the
+// interceptors first.
+func (c *Connection) Write(header ws.Header, frame io.Reader) error {
+	interceptors := c.interceptorsFor(ClientToRemote)
+	if len(interceptors) == 0 && c.schema == nil {
+		return c.write(header, frame)
+	}
+
+	opCode, payload, complete, err := c.sent.add(header, frame, c.config.FrameSizeLimit)
+	if err != nil || !complete {
+		return err
+	}
+	if rerr := c.validate(opCode, payload); rerr != nil {
+		c.session.SendMethod("warn", rerr)
+		return nil
+	}
+	messages, err := c.intercept(ClientToRemote, interceptors, InterceptedMessage{opCode, payload})
+	if err != nil {
+		c.reportInterceptError(ClientToRemote, err)
+		return nil
+	}
+
+	for _, msg := range messages {
+		frame := ws.MaskFrame(ws.NewFrame(msg.OpCode, true, msg.Payload))
+		if err := c.write(frame.Header, bytes.NewReader(frame.Payload)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receive sends a frame from the remote server on to the client. If there
+// are interceptors or the connection is sequenced, whole messages are
+// collected and run through the interceptors first.
+func (c *Connection) receive(header ws.Header, r io.Reader) {
+	interceptors := c.interceptorsFor(RemoteToClient)
+	if len(interceptors) == 0 && c.sequence == nil {
+		if err := c.session.CopyIndexedData(c.index, header, r); err == FrameTooLong {
+			c.signalClosed(ws.StatusMessageTooBig, "")
+		}
+		return
+	}
+
+	opCode, payload, complete, err := c.received.add(header, r, c.config.FrameSizeLimit)
+	Dispose(r)
+	if err == FrameTooLong {
+		c.signalClosed(ws.StatusMessageTooBig, "")
+		return
+	}
+	if err != nil || !complete {
+		return
+	}
+	messages, err := c.intercept(RemoteToClient, interceptors, InterceptedMessage{opCode, payload})
+	if err != nil {
+		c.reportInterceptError(RemoteToClient, err)
+		return
+	}
+
+	for _, msg := range messages {
+		if c.sequence != nil {
+			c.sequence.send(c.session, c.index, msg)
+		} else {
+			c.session.WriteIndexedData(c.index, ws.Header{Fin: true, OpCode: msg.OpCode}, msg.Payload)
+		}
+	}
+}
+
+// messageCollector puts the frames of fragmented messages back together.
+type messageCollector struct {
+	mu      sync.Mutex
+	opCode  ws.OpCode
+	payload []byte
+}
+
+// add adds the frame, unmasking it, and returns the whole message once its
+// last frame has been added. Messages longer than the limit are discarded
+// with FrameTooLong.
+func (m *messageCollector) add(header ws.Header, frame io.Reader, limit int64) (opCode ws.OpCode, payload []byte, complete bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if header.OpCode != ws.OpContinuation {
+		m.opCode, m.payload = header.OpCode, nil
+	}
+	if int64(len(m.payload))+header.Length > limit {
+		m.payload = nil
+		return 0, nil, false, FrameTooLong
+	}
+
+	data := make([]byte, header.Length)
+	if _, err := io.ReadFull(frame, data); err != nil {
+		m.payload = nil
+		return 0, nil, false, err
+	}
+	if header.Masked {
+		ws.Cipher(data, header.Mask, 0)
+	}
+	m.payload = append(m.payload, data...)
+	if !header.Fin {
+		return 0, nil, false, nil
+	}
+
+	opCode, payload = m.opCode, m.payload
+	m.payload = nil
+	return opCode, payload, true, nil
+}
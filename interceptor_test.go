@@ -0,0 +1,92 @@
+package wsplice
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectsFragmentedMessages(t *testing.T) {
+	var m messageCollector
+	mask := [4]byte{1, 2, 3, 4}
+	first := []byte("hello ")
+	ws.Cipher(first, mask, 0)
+
+	_, _, complete, err := m.add(ws.Header{OpCode: ws.OpText, Length: 6, Masked: true, Mask: mask}, bytes.NewReader(first), 100)
+	require.Nil(t, err)
+	assert.False(t, complete)
+	opCode, payload, complete, err := m.add(ws.Header{Fin: true, OpCode: ws.OpContinuation, Length: 5}, strings.NewReader("world"), 100)
+	require.Nil(t, err)
+	assert.True(t, complete)
+	assert.Equal(t, ws.OpCode(ws.OpText), opCode)
+	assert.Equal(t, "hello world", string(payload))
+
+	_, _, _, err = m.add(ws.Header{OpCode: ws.OpText, Length: 60}, strings.NewReader(strings.Repeat("a", 60)), 100)
+	require.Nil(t, err)
+	_, _, _, err = m.add(ws.Header{Fin: true, OpCode: ws.OpContinuation, Length: 60}, strings.NewReader(strings.Repeat("a", 60)), 100)
+	assert.Equal(t, FrameTooLong, err)
+}
+
+func (e *EndToEndSuite) TestInterceptsMessages() {
+	e.server.Intercept(ClientToRemote, func(in Interception, msg InterceptedMessage) ([]InterceptedMessage, error) {
+		switch string(msg.Payload) {
+		case `"drop"`:
+			return nil, nil
+		case `"invalid"`:
+			return nil, BadJSON
+		case `"broken"`:
+			return nil, errors.New("broken")
+		}
+		msg.Payload = bytes.ToUpper(msg.Payload)
+		return []InterceptedMessage{msg}, nil
+	})
+	e.server.Intercept(RemoteToClient, func(in Interception, msg InterceptedMessage) ([]InterceptedMessage, error) {
+		require.Equal(e.T(), RemoteToClient, in.Direction)
+		return []InterceptedMessage{msg, {OpCode: ws.OpText, Payload: []byte(`"injected"`)}}, nil
+	})
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"drop"`)
+	e.write(cnx, 0, `"broken"`)
+	e.write(cnx, 0, `"invalid"`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4000,"message":"Error parsing payload as JSON"}}`)
+
+	// Fragmented messages are intercepted whole.
+	message := `"` + strings.Repeat("a", 200*1024) + `"`
+	e.write(cnx, 0, message)
+	e.expectRead(cnx, 0, strings.ToUpper(message))
+	e.expectRead(cnx, 0, `"injected"`)
+}
+
+func (e *EndToEndSuite) TestInterceptsConnections() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	for i := 0; i < 2; i++ {
+		e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+		var reply struct{}
+		e.readJSON(cnx, 0xffff, &reply)
+	}
+	sessions := e.server.Sessions()
+	require.Len(e.T(), sessions, 1)
+	require.Nil(e.T(), sessions[0].Intercept(1, RemoteToClient, func(in Interception, msg InterceptedMessage) ([]InterceptedMessage, error) {
+		require.Equal(e.T(), 1, in.Index)
+		return []InterceptedMessage{{OpCode: msg.OpCode, Payload: []byte(`"redacted"`)}}, nil
+	}))
+	require.Equal(e.T(), UnknownConnection, sessions[0].Intercept(2, RemoteToClient, nil))
+
+	e.write(cnx, 0, `"secret"`)
+	e.expectRead(cnx, 0, `"secret"`)
+	e.write(cnx, 1, `"secret"`)
+	e.expectRead(cnx, 1, `"redacted"`)
+}
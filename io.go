@@ -1,7 +1,9 @@
 package wsplice
 
 import (
+	"encoding/binary"
 	"io"
+	"math/rand"
 
 	"github.com/gobwas/ws"
 )
@@ -32,7 +34,7 @@ func NewMasked(r *io.LimitedReader, offset int, mask [4]byte) *MaskedReader {
 }
 
 // Read implements io.Read
-func (m MaskedReader) Read(p []byte) (n int, err error) {
+func (m *MaskedReader) Read(p []byte) (n int, err error) {
 	offset := m.offset
 	n, err = m.LimitedReader.Read(p)
 	ws.Cipher(p[:n], m.mask, offset)
@@ -40,6 +42,12 @@ func (m MaskedReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+// newMask returns a random mask for a frame sent to a remote server.
+func newMask() (mask [4]byte) {
+	binary.BigEndian.PutUint32(mask[:], rand.Uint32())
+	return mask
+}
+
 // shiftCipher moves the mask to account for having remove "n" prefix bits.
 func shiftCipher(mask [4]byte, n int) (out [4]byte) {
 	switch n & 0x3 { // mod 4
@@ -0,0 +1,118 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// A MethodHandler handles calls to a control method registered with
+// Server.RegisterMethod. The context carries the calling Session, which
+// SessionFromContext returns, and params are the call's raw parameters.
+//
+// The result is marshaled as the call's reply. A *ResponseError or an
+// ErrorCode is sent back as the reply's error; other errors are logged, and
+// the client gets a MethodFailed error in their place.
+type MethodHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// builtinMethods are the methods clients may call that can't be registered.
+var builtinMethods = map[string]bool{
+	"connect":         true,
+	"terminate":       true,
+	"listConnections": true,
+	"subscribe":       true,
+	"ack":             true,
+	"resend":          true,
+}
+
+// builtinNotifications are the methods wsplice calls on clients, which can't
+// be sent with Notify.
+var builtinNotifications = map[string]bool{
+	"onSocketOpen":   true,
+	"onSocketClosed": true,
+	"warn":           true,
+	"notice":         true,
+}
+
+// RegisterMethod registers the handler for calls to the named method on the
+// control channel, in sessions started after it's registered. The names of
+// wsplice's own methods can't be registered.
+func (s *Server) RegisterMethod(name string, handler MethodHandler) error {
+	if builtinMethods[name] {
+		return fmt.Errorf("wsplice: the %q method is built in", name)
+	}
+
+	s.methodsMu.Lock()
+	defer s.methodsMu.Unlock()
+	if s.methods == nil {
+		s.methods = map[string]MethodHandler{}
+	}
+	s.methods[name] = handler
+
+	return nil
+}
+
+// addRegisteredMethods adds the server's registered methods to the session's.
+func (s *Session) addRegisteredMethods(methods methodMap) {
+	s.server.methodsMu.RLock()
+	defer s.server.methodsMu.RUnlock()
+
+	for name, handler := range s.server.methods {
+		methods[name] = s.callRegistered(name, handler)
+	}
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the Session a MethodHandler is called for, or
+// nil if the context doesn't carry one.
+func SessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// callRegistered wraps a registered handler, giving it the session in its
+// context and turning its errors into replies.
+func (s *Session) callRegistered(name string, handler MethodHandler) func(context.Context, json.RawMessage) (interface{}, error) {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		result, err := handler(context.WithValue(ctx, sessionKey{}, s), params)
+		switch t := err.(type) {
+		case nil:
+			return result, nil
+		case *ResponseError:
+			return nil, t
+		case ErrorCode:
+			return nil, t.ResponseError()
+		default:
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"id":     s.id,
+				"method": name,
+			}).Warn("Error handling a registered method")
+			return nil, MethodFailed.ResponseError()
+		}
+	}
+}
+
+// Notify calls the named method on the client with the params, without
+// waiting for a response, to send it the application's own notifications
+// on the control channel. The names of wsplice's own notifications can't be
+// used.
+func (s *Session) Notify(name string, params interface{}) error {
+	if builtinNotifications[name] {
+		return fmt.Errorf("wsplice: the %q notification is built in", name)
+	}
+
+	inner, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	s.SendControlFrame(Method{
+		Type:   "method",
+		Method: name,
+		Params: inner,
+	})
+
+	return nil
+}
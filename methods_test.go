@@ -0,0 +1,56 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/stretchr/testify/require"
+)
+
+func (e *EndToEndSuite) TestCallsRegisteredMethods() {
+	require.Nil(e.T(), e.server.RegisterMethod("getFeatureFlags", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var parsed struct{ Name string }
+		if err := json.Unmarshal(params, &parsed); err != nil {
+			return nil, BadJSON
+		}
+		session := SessionFromContext(ctx)
+		return map[string]interface{}{
+			"name":    parsed.Name,
+			"session": session.ID() != "",
+		}, nil
+	}))
+	require.Nil(e.T(), e.server.RegisterMethod("reauthenticate", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		if string(params) == `"bad"` {
+			return nil, &ResponseError{Code: 4401, Message: "Bad token", Path: "token"}
+		}
+		return nil, errors.New("broken")
+	}))
+	require.NotNil(e.T(), e.server.RegisterMethod("connect", nil))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"getFeatureFlags","params":{"name":"beta"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"name":"beta","session":true}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"getFeatureFlags","params":[]}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","error":{"code":4000,"message":"Error parsing payload as JSON"}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"reauthenticate","params":"bad"}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","error":{"code":4401,"message":"Bad token","path":"token"}}`)
+	e.write(cnx, 0xffff, `{"id":4,"type":"method","method":"reauthenticate","params":"good"}`)
+	e.expectRead(cnx, 0xffff, `{"id":4,"type":"reply","error":{"code":4018,"message":"An error occurred handling that method"}}`)
+}
+
+func (e *EndToEndSuite) TestSendsNotifications() {
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"listConnections","params":{}}`)
+	var reply struct{}
+	e.readJSON(cnx, 0xffff, &reply)
+
+	sessions := e.server.Sessions()
+	require.Len(e.T(), sessions, 1)
+	require.NotNil(e.T(), sessions[0].Notify("warn", nil))
+	require.Nil(e.T(), sessions[0].Notify("onFeatureFlags", map[string]bool{"beta": true}))
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onFeatureFlags","params":{"beta":true}}`)
+}
@@ -0,0 +1,81 @@
+package wsplice
+
+import (
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// OriginPolicy decides which browser origins may open sessions, so that
+// other websites can't open sessions from their visitors' browsers, and
+// what Origin remote servers see.
+//
+// Browsers always send an Origin header when opening a websocket, so
+// requests without one, which come from other kinds of clients, are
+// allowed.
+type OriginPolicy struct {
+	// Origins are exact origins like "https://example.com", or patterns
+	// where "*" matches any part of the hostname, like
+	// "https://*.example.com". "*" alone allows every origin.
+	Origins []string
+	// Patterns are regular expressions which allow the origins they match
+	// in full, as if they were anchored with ^ and $.
+	Patterns []*regexp.Regexp
+
+	// Forward sets the Origin header of requests to remote servers to the
+	// client's origin.
+	Forward bool
+	// Rewrite, if set, is the Origin header sent to remote servers instead.
+	// It takes precedence over Forward.
+	Rewrite string
+}
+
+// Allows returns whether clients may open sessions from the origin. A nil
+// policy allows every origin.
+func (p *OriginPolicy) Allows(origin string) bool {
+	if p == nil || origin == "" {
+		return true
+	}
+
+	return p.lists(origin)
+}
+
+// lists returns whether the policy allows the origin by name or pattern,
+// rather than by allowing every origin when there's no policy.
+func (p *OriginPolicy) lists(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.Origins {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if matched, _ := path.Match(allowed, origin); matched {
+			return true
+		}
+	}
+	for _, pattern := range p.Patterns {
+		if pattern.FindString(origin) == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setUpstreamOrigin sets the Origin header for a request to a remote server
+// on behalf of a client from the origin. Without a policy, the header the
+// client asked for, if any, is left alone.
+func (p *OriginPolicy) setUpstreamOrigin(headers http.Header, origin string) {
+	switch {
+	case p == nil:
+	case p.Rewrite != "":
+		headers.Set("Origin", p.Rewrite)
+	case p.Forward && origin != "":
+		headers.Set("Origin", origin)
+	}
+}
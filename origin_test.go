@@ -0,0 +1,86 @@
+package wsplice
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginPolicyAllows(t *testing.T) {
+	policy := &OriginPolicy{
+		Origins:  []string{"https://example.com", "https://*.example.org"},
+		Patterns: []*regexp.Regexp{regexp.MustCompile(`^http://localhost:\d+$`)},
+	}
+
+	tt := map[string]bool{
+		"":                          true,
+		"https://example.com":       true,
+		"https://EXAMPLE.com":       true,
+		"http://example.com":        false,
+		"https://evil.com":          false,
+		"https://example.com.evil":  false,
+		"https://ws.example.org":    true,
+		"https://example.org":       false,
+		"https://ws.example.org.io": false,
+		"http://localhost:8080":     true,
+		"http://localhost":          false,
+	}
+	for origin, expected := range tt {
+		require.Equal(t, expected, policy.Allows(origin), origin)
+	}
+
+	// Patterns match whole origins, even without anchors.
+	unanchored := &OriginPolicy{Patterns: []*regexp.Regexp{regexp.MustCompile(`https://app\.example\.com`)}}
+	require.True(t, unanchored.Allows("https://app.example.com"))
+	require.False(t, unanchored.Allows("https://app.example.com.evil.net"))
+	require.False(t, unanchored.Allows("https://evil.net/https://app.example.com"))
+
+	require.True(t, (*OriginPolicy)(nil).Allows("https://evil.com"))
+	require.True(t, (&OriginPolicy{Origins: []string{"*"}}).Allows("https://evil.com"))
+}
+
+func (e *EndToEndSuite) connectWithOrigin(origin string) (*websocket.Conn, *http.Response, error) {
+	return websocket.DefaultDialer.Dial("ws:"+e.wspliceServer.URL[5:], http.Header{"Origin": {origin}})
+}
+
+func (e *EndToEndSuite) TestRejectsDisallowedOrigins() {
+	e.server.AllowedOrigins = &OriginPolicy{Origins: []string{"https://example.com"}}
+
+	_, res, err := e.connectWithOrigin("https://evil.com")
+	require.NotNil(e.T(), err)
+	require.Equal(e.T(), http.StatusForbidden, res.StatusCode)
+
+	cnx, _, err := e.connectWithOrigin("https://example.com")
+	require.Nil(e.T(), err)
+	cnx.Close()
+}
+
+func (e *EndToEndSuite) TestSetsUpstreamOrigins() {
+	url := e.makeHeaderServer("Origin")
+	tt := []struct {
+		policy   *OriginPolicy
+		expected string
+	}{
+		{nil, "https://client.example.com"},
+		{&OriginPolicy{Origins: []string{"*"}}, "https://client.example.com"},
+		{&OriginPolicy{Origins: []string{"*"}, Forward: true}, "https://example.com"},
+		{&OriginPolicy{Origins: []string{"*"}, Forward: true, Rewrite: "https://wsplice.example.com"}, "https://wsplice.example.com"},
+	}
+
+	for _, test := range tt {
+		e.server.AllowedOrigins = test.policy
+		cnx, _, err := e.connectWithOrigin("https://example.com")
+		require.Nil(e.T(), err)
+
+		// Unless the origin is forwarded or rewritten, clients can choose
+		// what's sent.
+		e.write(cnx, 0xffff, `{"type":"method","method":"connect","params":{"url":"`+url+`","headers":{"Origin":"https://client.example.com"}}}`)
+		e.expectRead(cnx, 0xffff, `{"id":0,"type":"reply","result":{"index":0}}`)
+		e.write(cnx, 0, `"origin?"`)
+		e.expectRead(cnx, 0, `"`+test.expected+`"`)
+		cnx.Close()
+	}
+}
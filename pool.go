@@ -0,0 +1,286 @@
+package wsplice
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultMaxFailures is how many dials to a backend may fail in a row
+	// before it's ejected, if the Upstream doesn't say.
+	defaultMaxFailures = 3
+	// defaultEjectionTime is how long backends are ejected for, if the
+	// Upstream doesn't say.
+	defaultEjectionTime = 30 * time.Second
+	// defaultHealthCheckTimeout is how long health checks wait for backends
+	// to answer, if the Upstream has no DialTimeout.
+	defaultHealthCheckTimeout = 10 * time.Second
+)
+
+// A Balancer chooses which of an upstream's backends each connection is
+// dialed to.
+type Balancer string
+
+const (
+	// RoundRobin takes turns between the backends. It's the default.
+	RoundRobin Balancer = "round-robin"
+	// LeastConnections picks the backend with the fewest open connections.
+	LeastConnections Balancer = "least-connections"
+	// ConsistentHash sends connections with the same "hashKey" to the same
+	// backend, for as long as it's available. Connections without a key
+	// are balanced round-robin.
+	ConsistentHash Balancer = "consistent-hash"
+)
+
+// pool tracks the health and load of an upstream's backends.
+type pool struct {
+	upstream *Upstream
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	backends []*backend
+	next     int
+}
+
+// backend is one of the servers in a pool.
+type backend struct {
+	active int64 // open connections, accessed atomically
+
+	url string
+
+	// These are guarded by the pool's mu.
+	failures     int
+	ejectedUntil time.Time
+	unhealthy    bool
+}
+
+// backendConn is a connection to a backend, which counts as one of its
+// active connections until it's closed.
+type backendConn struct {
+	net.Conn
+	url       string
+	backend   *backend
+	closeOnce sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.closeOnce.Do(func() { atomic.AddInt64(&c.backend.active, -1) })
+	return c.Conn.Close()
+}
+
+// getPool returns the upstream's pool, creating it and starting its health
+// checks the first time.
+func (u *Upstream) getPool() *pool {
+	u.poolOnce.Do(func() {
+		u.pool = &pool{upstream: u, stop: make(chan struct{})}
+		for _, url := range u.Backends {
+			u.pool.backends = append(u.pool.backends, &backend{url: url})
+		}
+		if u.HealthCheckInterval > 0 {
+			go u.pool.checkHealth()
+		}
+	})
+
+	return u.pool
+}
+
+// StartHealthChecks starts checking the health of the upstream's Backends,
+// if it has a HealthCheckInterval. Otherwise they're started when the first
+// connection is dialed.
+func (u *Upstream) StartHealthChecks() {
+	if len(u.Backends) > 0 {
+		u.getPool()
+	}
+}
+
+// StopHealthChecks stops checking the health of the upstream's Backends,
+// once it's no longer in use.
+func (u *Upstream) StopHealthChecks() {
+	if len(u.Backends) > 0 {
+		p := u.getPool()
+		p.stopOnce.Do(func() { close(p.stop) })
+	}
+}
+
+// dial dials a backend with the function, retrying on other backends if it
+// fails until they've all been tried or the context is done.
+func (p *pool) dial(ctx context.Context, cmd ConnectCommand, dial func(url string) (net.Conn, ws.Response, error)) (net.Conn, ws.Response, error) {
+	var (
+		tried   = map[*backend]bool{}
+		lastErr error
+	)
+	for {
+		b := p.pick(cmd.HashKey, tried)
+		if b == nil {
+			return nil, ws.Response{}, lastErr
+		}
+		tried[b] = true
+
+		url, err := targetURL(b.url, cmd)
+		if err != nil {
+			return nil, ws.Response{}, err
+		}
+		conn, resp, err := dial(url)
+		if err == nil {
+			p.succeeded(b)
+			atomic.AddInt64(&b.active, 1)
+			return &backendConn{Conn: conn, url: url, backend: b}, resp, nil
+		}
+
+		lastErr = err
+		if ctx.Err() == context.Canceled {
+			// The client went away, which says nothing about the backend.
+			return nil, ws.Response{}, lastErr
+		}
+		p.failed(b, err)
+		if ctx.Err() != nil {
+			return nil, ws.Response{}, lastErr
+		}
+	}
+}
+
+// pick returns the backend to dial next, from those which haven't been
+// tried, or nil if they all have. Backends which are ejected or unhealthy
+// are only picked if there are no others.
+func (p *pool) pick(key string, tried map[*backend]bool) *backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var available, fallback []*backend
+	now := time.Now()
+	for _, b := range p.backends {
+		switch {
+		case tried[b]:
+		case b.unhealthy || now.Before(b.ejectedUntil):
+			fallback = append(fallback, b)
+		default:
+			available = append(available, b)
+		}
+	}
+	if len(available) == 0 {
+		available = fallback
+	}
+	if len(available) == 0 {
+		return nil
+	}
+
+	switch {
+	case p.upstream.Balancer == LeastConnections:
+		best := available[0]
+		for _, b := range available[1:] {
+			if atomic.LoadInt64(&b.active) < atomic.LoadInt64(&best.active) {
+				best = b
+			}
+		}
+		return best
+	case p.upstream.Balancer == ConsistentHash && key != "":
+		// Rendezvous hashing: each key goes to the backend it scores
+		// highest with, so only the keys on a backend which becomes
+		// unavailable move elsewhere.
+		var best *backend
+		var bestScore uint64
+		for _, b := range available {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(b.url))
+			if score := h.Sum64(); best == nil || score > bestScore {
+				best, bestScore = b, score
+			}
+		}
+		return best
+	default:
+		p.next++
+		return available[p.next%len(available)]
+	}
+}
+
+// succeeded records that the backend was dialed.
+func (p *pool) succeeded(b *backend) {
+	p.mu.Lock()
+	b.failures = 0
+	p.mu.Unlock()
+}
+
+// failed records that dialing the backend failed, ejecting it if it's
+// failed too many times in a row.
+func (p *pool) failed(b *backend, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	maxFailures, ejectionTime := p.upstream.MaxFailures, p.upstream.EjectionTime
+	if maxFailures <= 0 {
+		maxFailures = defaultMaxFailures
+	}
+	if ejectionTime <= 0 {
+		ejectionTime = defaultEjectionTime
+	}
+
+	b.failures++
+	if b.failures >= maxFailures {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(ejectionTime)
+		logrus.WithError(err).WithFields(logrus.Fields{"backend": tracedURL(b.url), "duration": ejectionTime}).
+			Warn("Ejecting backend after failed dials")
+	}
+}
+
+// checkHealth dials each backend every HealthCheckInterval until the pool is
+// stopped, marking those which fail as unhealthy until they succeed again.
+func (p *pool) checkHealth() {
+	ticker := time.NewTicker(p.upstream.HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				p.checkBackend(b)
+			}(b)
+		}
+		wg.Wait()
+	}
+}
+
+// checkBackend dials the backend to check its health.
+func (p *pool) checkBackend(b *backend) {
+	timeout := p.upstream.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	conn, _, err := ws.Dialer{TLSConfig: p.upstream.TLSConfig}.Dial(ctx, b.url, p.upstream.header())
+	if err == nil {
+		conn.Close()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if unhealthy := err != nil; unhealthy != b.unhealthy {
+		b.unhealthy = unhealthy
+		entry := logrus.WithField("backend", tracedURL(b.url))
+		if unhealthy {
+			entry.WithError(err).Warn("Backend failed its health check")
+		} else {
+			entry.Info("Backend passed its health check")
+		}
+	}
+}
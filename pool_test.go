@@ -0,0 +1,131 @@
+package wsplice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/stretchr/testify/require"
+)
+
+// pickURLs picks a backend from the upstream's pool count times, returning
+// their URLs.
+func pickURLs(u *Upstream, key string, count int) []string {
+	var urls []string
+	for i := 0; i < count; i++ {
+		urls = append(urls, u.getPool().pick(key, nil).url)
+	}
+
+	return urls
+}
+
+func TestPoolBalancesRoundRobin(t *testing.T) {
+	u := &Upstream{Backends: []string{"ws://a", "ws://b", "ws://c"}}
+	require.Equal(t, []string{"ws://b", "ws://c", "ws://a", "ws://b"}, pickURLs(u, "", 4))
+}
+
+func TestPoolBalancesLeastConnections(t *testing.T) {
+	u := &Upstream{Backends: []string{"ws://a", "ws://b", "ws://c"}, Balancer: LeastConnections}
+	backends := u.getPool().backends
+	backends[0].active, backends[1].active, backends[2].active = 3, 1, 2
+	require.Equal(t, []string{"ws://b", "ws://b"}, pickURLs(u, "", 2))
+}
+
+func TestPoolBalancesConsistentHash(t *testing.T) {
+	u := &Upstream{Backends: []string{"ws://a", "ws://b", "ws://c", "ws://d"}, Balancer: ConsistentHash}
+	picked := pickURLs(u, "room-5", 3)
+	require.Equal(t, picked[0], picked[1])
+	require.Equal(t, picked[0], picked[2])
+
+	// Keys move off backends which are ejected, but no others move.
+	others := map[string]string{}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		others[key] = pickURLs(u, key, 1)[0]
+	}
+	for _, b := range u.getPool().backends {
+		if b.url == picked[0] {
+			b.ejectedUntil = time.Now().Add(time.Minute)
+		}
+	}
+	require.NotEqual(t, picked[0], pickURLs(u, "room-5", 1)[0])
+	for key, url := range others {
+		if url != picked[0] {
+			require.Equal(t, url, pickURLs(u, key, 1)[0], key)
+		}
+	}
+}
+
+func TestPoolEjectsFailingBackends(t *testing.T) {
+	u := &Upstream{Backends: []string{"ws://a", "ws://b"}, MaxFailures: 2, Balancer: LeastConnections}
+	p := u.getPool()
+	a := p.backends[0]
+
+	p.failed(a, errors.New("nope"))
+	require.Equal(t, "ws://a", p.pick("", nil).url)
+	p.failed(a, errors.New("nope"))
+	require.Equal(t, "ws://b", p.pick("", nil).url)
+
+	// Ejected backends are still tried if there's nothing else.
+	require.Equal(t, "ws://a", p.pick("", map[*backend]bool{p.backends[1]: true}).url)
+	require.Nil(t, p.pick("", map[*backend]bool{p.backends[0]: true, p.backends[1]: true}))
+}
+
+func TestPoolIgnoresCancelledDials(t *testing.T) {
+	u := &Upstream{Backends: []string{"ws://a", "ws://b"}}
+	p := u.getPool()
+	ctx, cancel := context.WithCancel(context.Background())
+	_, _, err := p.dial(ctx, ConnectCommand{}, func(string) (net.Conn, ws.Response, error) {
+		cancel()
+		return nil, ws.Response{}, context.Canceled
+	})
+	require.Equal(t, context.Canceled, err)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, b := range p.backends {
+		require.Zero(t, b.failures, b.url)
+	}
+}
+
+func (e *EndToEndSuite) TestRetriesPooledTargets() {
+	live := e.makeServer(forever(echo))
+	e.config.Upstreams = map[string]*Upstream{
+		"chat": {Backends: []string{"ws://127.0.0.1:1", live}, Balancer: LeastConnections},
+	}
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"target":"chat","path":"/room"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, "hello")
+	e.expectRead(cnx, 0, "hello")
+
+	connections := e.waitForSessions(1)[0].ListConnections()
+	require.Equal(e.T(), live+"/room", connections[0].URL)
+	backends := e.config.Upstreams["chat"].getPool().backends
+	require.Equal(e.T(), int64(1), atomic.LoadInt64(&backends[1].active))
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	require.Eventually(e.T(), func() bool { return atomic.LoadInt64(&backends[1].active) == 0 }, time.Second, 5*time.Millisecond)
+}
+
+func (e *EndToEndSuite) TestChecksBackendHealth() {
+	u := &Upstream{Backends: []string{"ws://127.0.0.1:1", e.makeServer(forever(echo))}, HealthCheckInterval: 10 * time.Millisecond}
+	u.StartHealthChecks()
+	defer u.StopHealthChecks()
+
+	p := u.getPool()
+	require.Eventually(e.T(), func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.backends[0].unhealthy
+	}, time.Second, 5*time.Millisecond)
+
+	p.mu.Lock()
+	require.False(e.T(), p.backends[1].unhealthy)
+	p.mu.Unlock()
+}
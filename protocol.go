@@ -4,8 +4,19 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// SubprotocolV1 is the websocket subprotocol for this version of the wsplice
+// protocol. Clients may ask for it to make sure the server understands
+// them; wsplice also accepts clients which don't ask for a subprotocol.
+const SubprotocolV1 = "wsplice.v1"
+
+// supportsSubprotocol returns whether the server speaks the subprotocol.
+func supportsSubprotocol(protocol string) bool {
+	return protocol == SubprotocolV1
+}
+
 type ErrorCode uint
 
 const (
@@ -17,6 +28,20 @@ const (
 	InvalidURL
 	InvalidHostname
 	DialError
+	ConnectQueueFull
+	InvalidIndex
+	IndexInUse
+	IndexesExhausted
+	HeaderNotForwardable
+	UnknownTarget
+	RawURLForbidden
+	SharedConnectionReadOnly
+	TopicForbidden
+	TopicReadOnly
+	MethodFailed
+	InvalidPayload
+	NotSequenced
+	SequenceUnavailable
 )
 
 func (e ErrorCode) Error() string {
@@ -26,7 +51,7 @@ func (e ErrorCode) Error() string {
 	case UnknownMethod:
 		return "Unknown method name"
 	case UnknownConnection:
-			return "You are trying to send to a connection which does not exist"
+		return "You are trying to send to a connection which does not exist"
 	case FrameTooShort:
 		return "The provided frame was too short, it must start with an socket index, or 0"
 	case FrameTooLong:
@@ -35,11 +60,45 @@ func (e ErrorCode) Error() string {
 		return "Invalid URL provided"
 	case InvalidHostname:
 		return "You are not allowd to connect to that hostname"
+	case ConnectQueueFull:
+		return "Too many messages were sent to a connection that is still connecting"
+	case InvalidIndex:
+		return "The requested index is out of range"
+	case IndexInUse:
+		return "The requested index is in use or was used too recently"
+	case IndexesExhausted:
+		return "There are no more indices available in this session"
+	case HeaderNotForwardable:
+		return "That header from the upgrade request may not be forwarded"
+	case UnknownTarget:
+		return "There is no target with that name"
+	case RawURLForbidden:
+		return "You must connect to a named target rather than a URL"
+	case SharedConnectionReadOnly:
+		return "You may not send messages to a shared connection"
+	case TopicForbidden:
+		return "You may not subscribe to that topic"
+	case TopicReadOnly:
+		return "You may not publish to that topic"
+	case MethodFailed:
+		return "An error occurred handling that method"
+	case InvalidPayload:
+		return "The message does not match the target's schema"
+	case NotSequenced:
+		return "That connection does not have sequence numbers"
+	case SequenceUnavailable:
+		return "Those messages are no longer retained"
 	default:
 		return fmt.Sprintf("Unknown error code %d", e)
 	}
 }
 
+// isErrorCode returns whether the error is an ErrorCode.
+func isErrorCode(err error) bool {
+	_, ok := err.(ErrorCode)
+	return ok
+}
+
 func (e ErrorCode) ResponseError() *ResponseError {
 	return &ResponseError{Code: e, Message: e.Error()}
 }
@@ -57,6 +116,49 @@ type ConnectCommand struct {
 	Headers      map[string]string `json:"headers"`
 	Subprotocols []string          `json:"subprotocols"`
 	Timeout      int               `json:"timeout"`
+
+	// Target names one of the server's Upstreams to connect to, instead of
+	// giving a URL. The Path and Query are added to the upstream's URL.
+	Target string            `json:"target"`
+	Path   string            `json:"path"`
+	Query  map[string]string `json:"query"`
+	// HashKey picks the backend of a pooled target which uses consistent
+	// hashing. Connections with the same key go to the same backend.
+	HashKey string `json:"hashKey"`
+
+	// Async, when true, causes the index to be returned immediately, before
+	// the remote server is dialed. Messages sent to the index are queued
+	// until it opens. The client is notified with onSocketOpen or
+	// onSocketClosed once the dial completes.
+	Async bool `json:"async"`
+
+	// Index optionally specifies the index the client wants the connection
+	// to have. If it's not given, wsplice allocates one.
+	Index *int `json:"index"`
+
+	// IdleTimeout is the time in milliseconds the connection may go without
+	// traffic before wsplice closes it. It's limited by the server's maximum.
+	IdleTimeout int `json:"idleTimeout"`
+
+	// Shared, when true, subscribes the client to a connection which is
+	// shared with every other session connecting to the same URL or target
+	// with the same headers and subprotocols, rather than dialing its own.
+	// Every subscriber gets the messages the remote server sends. Clients
+	// may only send messages to it if the server's SharedWrites allows.
+	Shared bool `json:"shared"`
+
+	// ForwardHeaders names headers from the client's upgrade request, like
+	// its cookies, to send to the remote server. They must be allowed by
+	// the server's ForwardableHeaders.
+	ForwardHeaders []string `json:"forwardHeaders"`
+
+	// Sequenced, when true, numbers each message sent to the client on the
+	// connection, and retains them until they're acknowledged with "ack" so
+	// that they can be sent again with "resend".
+	Sequenced bool `json:"sequenced"`
+
+	// upstream is the Upstream the Target resolved to.
+	upstream *Upstream
 }
 
 // ConnectResponse is sent back in response to a ConnectCommand
@@ -64,6 +166,52 @@ type ConnectResponse struct {
 	Index int `json:"index"` // newly-allocated index to use to reference this socket
 }
 
+// SocketOpenCommand is sent to the client once an asynchronous connection
+// has been established.
+type SocketOpenCommand struct {
+	Index       int    `json:"index"`
+	Subprotocol string `json:"subprotocol"`
+}
+
+// A SubscribeCommand is sent to subscribe to a topic. Messages published to
+// the topic are sent to the client on the index it's given, and messages
+// the client sends to the index are published to the topic.
+type SubscribeCommand struct {
+	Topic       string `json:"topic"`
+	Index       *int   `json:"index"`
+	IdleTimeout int    `json:"idleTimeout"`
+	Sequenced   bool   `json:"sequenced"`
+}
+
+// SubscribeResponse is sent back in response to a SubscribeCommand.
+type SubscribeResponse struct {
+	Index int `json:"index"`
+}
+
+// An AckCommand acknowledges the messages a sequenced connection has sent,
+// up to and including the sequence number, so that they're no longer
+// retained.
+type AckCommand struct {
+	Index    int    `json:"index"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// An AckResponse is sent in response to an AckCommand.
+type AckResponse struct {
+}
+
+// A ResendCommand asks for the messages a sequenced connection has sent from
+// the sequence number on to be sent again.
+type ResendCommand struct {
+	Index int    `json:"index"`
+	From  uint64 `json:"from"`
+}
+
+// A ResendResponse is sent in response to a ResendCommand, after the
+// messages have been sent again.
+type ResendResponse struct {
+}
+
 // A TerminateCommand is sent to signalClosed a socket, by its index.
 type TerminateCommand struct {
 	Index  int    `json:"index"`
@@ -75,6 +223,42 @@ type TerminateCommand struct {
 type TerminateResponse struct {
 }
 
+// ListConnectionsCommand is sent on the control socket to request information
+// about all of the session's connections.
+type ListConnectionsCommand struct {
+}
+
+// ListConnectionsResponse is sent in response to a ListConnectionsCommand.
+type ListConnectionsResponse struct {
+	Connections []ConnectionInfo `json:"connections"`
+	RTT         float64          `json:"rtt"` // to the client in milliseconds, zero if not measured
+}
+
+// ConnectionInfo describes a single connection and its traffic. "Sent"
+// counters refer to data going to the remote server, and "received" counters
+// to data coming back from it.
+type ConnectionInfo struct {
+	Index            int             `json:"index"`
+	URL              string          `json:"url,omitempty"`
+	Target           string          `json:"target,omitempty"`
+	Topic            string          `json:"topic,omitempty"`
+	Subprotocol      string          `json:"subprotocol"`
+	State            ConnectionState `json:"state"`
+	OpenedAt         time.Time       `json:"openedAt"`
+	LastActivity     time.Time       `json:"lastActivity"`
+	SentBytes        int64           `json:"sentBytes"`
+	SentMessages     int64           `json:"sentMessages"`
+	ReceivedBytes    int64           `json:"receivedBytes"`
+	ReceivedMessages int64           `json:"receivedMessages"`
+	RTT              float64         `json:"rtt"` // in milliseconds, zero if not measured
+}
+
+// NoticeCommand is sent to the client when a wsplice operator broadcasts a
+// message to all sessions.
+type NoticeCommand struct {
+	Message string `json:"message"`
+}
+
 type SocketClosedCommand struct {
 	Index  int    `json:"index"`
 	Code   int    `json:"code"`
@@ -102,6 +286,9 @@ type ResponseError struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
 	Path    string    `json:"path,omitempty"`
+	// Index is the connection the error is about, for errors which aren't
+	// replies to method calls.
+	Index *int `json:"index,omitempty"`
 }
 
 func (r ResponseError) Error() string { return r.Message }
@@ -0,0 +1,92 @@
+package wsplice
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/gobwas/ws"
+	"github.com/sirupsen/logrus"
+)
+
+// rawHeaderSize is the size of the header before each frame on raw
+// connections: the length of what follows, as a uint32, and the frame's
+// websocket opcode.
+const rawHeaderSize = 5
+
+// errRawMessage is returned when a raw client sends a frame wsplice can't
+// relay, or wsplice would send one raw clients can't be sent.
+var errRawMessage = errors.New("wsplice: invalid message on raw connection")
+
+// ServeRaw runs a session on a connection which carries the wsplice
+// protocol without websockets, until either side closes it. Each frame, in
+// both directions, is framed by its length and opcode, big-endian:
+//
+//	uint32 length | uint8 opcode | uint16 index | payload
+//
+// where the length counts the index and payload, and the opcode is 1 for
+// text and 2 for binary. Messages aren't fragmented. Close, ping and pong
+// frames, with opcodes 8, 9 and 10, have their websocket payload instead of
+// an index and payload, and work as they do on websockets, so raw clients
+// must answer pings to stay connected. Messages longer than the config's
+// FrameSizeLimit close the connection. If the connection is a *tls.Conn,
+// its certificate gives the session's identity.
+func (s *Server) ServeRaw(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	if s.Draining() {
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			logrus.WithError(err).Debug("Error in TLS handshake with raw client")
+			return
+		}
+	}
+
+	s.serve(ctx, conn, rawFraming{limit: s.currentConfig().FrameSizeLimit})
+}
+
+// rawFraming delimits frames with the headers of ServeRaw.
+type rawFraming struct {
+	limit int64
+}
+
+func (f rawFraming) readHeader(r io.Reader) (ws.Header, error) {
+	var b [rawHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return ws.Header{}, err
+	}
+
+	header := ws.Header{
+		Fin:    true,
+		OpCode: ws.OpCode(b[4]),
+		Length: int64(binary.BigEndian.Uint32(b[:])),
+	}
+	switch header.OpCode {
+	case ws.OpText, ws.OpBinary:
+		if header.Length < indexBytesSize || header.Length-indexBytesSize > f.limit {
+			return header, errRawMessage
+		}
+	case ws.OpClose, ws.OpPing, ws.OpPong:
+	default:
+		return header, errRawMessage
+	}
+
+	return header, nil
+}
+
+func (f rawFraming) writeHeader(w io.Writer, header ws.Header) error {
+	if !header.Fin || header.OpCode == ws.OpContinuation {
+		return errRawMessage
+	}
+
+	var b [rawHeaderSize]byte
+	binary.BigEndian.PutUint32(b[:], uint32(header.Length))
+	b[4] = byte(header.OpCode)
+	_, err := w.Write(b[:])
+	return err
+}
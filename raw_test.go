@@ -0,0 +1,116 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRaw writes a message to a raw connection, framed by its length and
+// opcode.
+func writeRaw(w io.Writer, index int, opCode ws.OpCode, payload []byte) error {
+	b := make([]byte, rawHeaderSize+indexBytesSize+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(indexBytesSize+len(payload)))
+	b[4] = byte(opCode)
+	binary.BigEndian.PutUint16(b[rawHeaderSize:], uint16(index))
+	copy(b[rawHeaderSize+indexBytesSize:], payload)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// readRaw reads a frame from a raw connection, returning its opcode and
+// everything after its header.
+func (e *EndToEndSuite) readRaw(conn net.Conn) (ws.OpCode, []byte) {
+	header := make([]byte, rawHeaderSize)
+	_, err := io.ReadFull(conn, header)
+	e.expectNoerr(err)
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(conn, payload)
+	e.expectNoerr(err)
+
+	return ws.OpCode(header[4]), payload
+}
+
+func (e *EndToEndSuite) expectReadRaw(conn net.Conn, index int, opCode ws.OpCode, expected string) {
+	actualOpCode, payload := e.readRaw(conn)
+	require.Equal(e.T(), opCode, actualOpCode)
+	require.Equal(e.T(), index, int(binary.BigEndian.Uint16(payload)))
+	if expected[0] == '{' {
+		require.JSONEq(e.T(), expected, string(payload[indexBytesSize:]))
+	} else {
+		require.Equal(e.T(), expected, string(payload[indexBytesSize:]))
+	}
+}
+
+func (e *EndToEndSuite) TestServesRawConnections() {
+	url := e.makeServer(forever(echo))
+	client, conn := net.Pipe()
+	defer client.Close()
+	go e.server.ServeRaw(context.Background(), conn)
+
+	e.expectNoerr(writeRaw(client, 0xffff, ws.OpText, []byte(`{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)))
+	e.expectReadRaw(client, 0xffff, ws.OpText, `{"id":1,"type":"reply","result":{"index":0}}`)
+
+	e.expectNoerr(writeRaw(client, 0, ws.OpText, []byte("hello")))
+	e.expectReadRaw(client, 0, ws.OpText, "hello")
+	e.expectNoerr(writeRaw(client, 0, ws.OpBinary, []byte{0, 1, 2}))
+	e.expectReadRaw(client, 0, ws.OpBinary, "\x00\x01\x02")
+
+	// Raw clients end sessions with close frames, which are answered.
+	require.Len(e.T(), e.waitForSessions(1), 1)
+	close := ws.NewCloseFrame(ws.StatusNormalClosure, "bye")
+	_, err := client.Write(append([]byte{0, 0, 0, byte(len(close.Payload)), byte(ws.OpClose)}, close.Payload...))
+	e.expectNoerr(err)
+	opCode, payload := e.readRaw(client)
+	require.Equal(e.T(), ws.OpCode(ws.OpClose), opCode)
+	code, _ := ws.ParseCloseFrameData(payload)
+	require.Equal(e.T(), ws.StatusGoingAway, code)
+	_, err = client.Read(make([]byte, 1))
+	require.Equal(e.T(), io.EOF, err)
+	e.waitForSessions(0)
+}
+
+func (e *EndToEndSuite) TestPingsRawConnections() {
+	e.config.ClientPingInterval = 10 * time.Millisecond
+	e.config.ReadTimeout = 20 * time.Millisecond
+	client, conn := net.Pipe()
+	defer client.Close()
+	go e.server.ServeRaw(context.Background(), conn)
+
+	// Clients which answer pings stay connected.
+	for i := 0; i < 5; i++ {
+		opCode, payload := e.readRaw(client)
+		require.Equal(e.T(), ws.OpCode(ws.OpPing), opCode)
+		_, err := client.Write(append([]byte{0, 0, 0, byte(len(payload)), byte(ws.OpPong)}, payload...))
+		e.expectNoerr(err)
+	}
+	require.Len(e.T(), e.waitForSessions(1), 1)
+
+	// Those which stop are disconnected.
+	var err error
+	for err == nil {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = client.Read(make([]byte, 64))
+	}
+	require.Equal(e.T(), io.EOF, err)
+	e.waitForSessions(0)
+}
+
+func (e *EndToEndSuite) TestRejectsInvalidRawFrames() {
+	client, conn := net.Pipe()
+	defer client.Close()
+	go e.server.ServeRaw(context.Background(), conn)
+
+	require.Len(e.T(), e.waitForSessions(1), 1)
+	_, err := client.Write([]byte{0, 0, 0, 2, 3})
+	e.expectNoerr(err)
+	opCode, _ := e.readRaw(client)
+	require.Equal(e.T(), ws.OpCode(ws.OpClose), opCode)
+	e.waitForSessions(0)
+}
@@ -0,0 +1,270 @@
+package wsplice
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// recordingMagic starts every recording, followed by its version.
+const recordingMagic = "WSREC\x01"
+
+// maxRecordingHeaderSize and maxRecordedFrameSize bound the lengths read from
+// recordings, so corrupt ones can't make readers allocate without end.
+const (
+	maxRecordingHeaderSize = 64 * 1024
+	maxRecordedFrameSize   = 1 << 30
+)
+
+// ErrNotRecording is returned when reading a file that isn't a recording.
+var ErrNotRecording = errors.New("wsplice: not a session recording")
+
+// A Recorder writes the frames going through sessions to files, so that they
+// can be replayed with "wsplice replay" to reproduce bugs.
+type Recorder struct {
+	// Dir is where recordings are written, each named after the ID of its
+	// session with a ".wsrec" extension.
+	Dir string
+	// Identities are matched against the common name of clients'
+	// certificates, where "*" matches any part of it. Sessions of clients
+	// with matching identities are always recorded.
+	Identities []string
+	// SampleRate is the fraction of other sessions to record, from 0 for
+	// none to 1 for all of them.
+	SampleRate float64
+}
+
+// records returns whether the session of a client with the identity should
+// be recorded.
+func (r *Recorder) records(identity string) bool {
+	for _, pattern := range r.Identities {
+		if matched, _ := path.Match(pattern, identity); matched {
+			return true
+		}
+	}
+
+	return r.SampleRate > 0 && rand.Float64() < r.SampleRate
+}
+
+// RecordingHeader describes the session a recording was made of.
+type RecordingHeader struct {
+	SessionID   string    `json:"sessionId"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	Identity    string    `json:"identity,omitempty"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+}
+
+// A RecordedFrame is a frame which went through a recorded session. The
+// frames the client sent are recorded ClientToRemote, and those wsplice sent
+// it RemoteToClient, including control messages at the control index. Index
+// prefixes are taken off payloads and payloads are unmasked; continuation
+// frames have the index of the frame their message started with.
+type RecordedFrame struct {
+	// Time is how long after the session started the frame went through.
+	Time      time.Duration
+	Direction Direction
+	Index     int
+	OpCode    ws.OpCode
+	Fin       bool
+	Payload   []byte
+}
+
+// recording writes the frames of a session to a file.
+type recording struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	started time.Time
+
+	// index is the index of the last data frame the client sent, for its
+	// continuation frames. It's only used by the session's read loop.
+	index int
+}
+
+// open creates the file to record the session to, and writes its header.
+func (r *Recorder) open(s *Session) (*recording, error) {
+	if err := os.MkdirAll(r.Dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(r.Dir, s.id+".wsrec"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _ := json.Marshal(RecordingHeader{
+		SessionID:   s.id,
+		RemoteAddr:  s.remoteAddr,
+		Identity:    s.identity,
+		Subprotocol: s.subprotocol,
+		StartedAt:   s.startedAt,
+	})
+	w := bufio.NewWriter(file)
+	w.WriteString(recordingMagic)
+	writeUvarint(w, uint64(len(header)))
+	w.Write(header)
+
+	return &recording{file: file, w: w, started: s.startedAt}, nil
+}
+
+// record appends a frame to the recording. Each is written as the time since
+// the session started, a byte holding its direction, fin bit and opcode, its
+// index, and its length-prefixed payload.
+func (r *recording) record(direction Direction, index int, header ws.Header, payload []byte) {
+	flags := byte(header.OpCode) & 0x0f
+	if direction == RemoteToClient {
+		flags |= 0x80
+	}
+	if header.Fin {
+		flags |= 0x40
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	writeUvarint(r.w, uint64(time.Since(r.started)))
+	r.w.WriteByte(flags)
+	binary.Write(r.w, binary.BigEndian, uint16(index))
+	writeUvarint(r.w, uint64(len(payload)))
+	r.w.Write(payload)
+}
+
+// readClientFrame reads a frame the client sent and records it, returning a
+// reader for the frame, still masked, to use in the socket's place. Frames
+// longer than the limit aren't read, and give FrameTooLong.
+func (r *recording) readClientFrame(header ws.Header, frame io.Reader, limit int64) (*io.LimitedReader, error) {
+	if header.Length > limit {
+		return nil, FrameTooLong
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(frame, payload); err != nil {
+		return nil, err
+	}
+
+	unmasked := append([]byte(nil), payload...)
+	if header.Masked {
+		ws.Cipher(unmasked, header.Mask, 0)
+	}
+	switch header.OpCode {
+	case ws.OpText, ws.OpBinary:
+		if len(unmasked) >= indexBytesSize {
+			r.index = int(binary.BigEndian.Uint16(unmasked))
+			unmasked = unmasked[indexBytesSize:]
+		}
+		r.record(ClientToRemote, r.index, header, unmasked)
+	case ws.OpContinuation:
+		r.record(ClientToRemote, r.index, header, unmasked)
+	case ws.OpClose:
+		r.record(ClientToRemote, 0, header, unmasked)
+	}
+
+	return &io.LimitedReader{R: bytes.NewReader(payload), N: header.Length}, nil
+}
+
+// close flushes the recording and closes its file.
+func (r *recording) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+// A RecordingReader reads the frames of a recording in the order they went
+// through its session.
+type RecordingReader struct {
+	Header RecordingHeader
+
+	r *bufio.Reader
+}
+
+// NewRecordingReader reads the header of a recording, returning
+// ErrNotRecording if it doesn't start with one.
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordingMagic {
+		return nil, ErrNotRecording
+	}
+	length, err := binary.ReadUvarint(br)
+	if err != nil || length > maxRecordingHeaderSize {
+		return nil, ErrNotRecording
+	}
+	header := make([]byte, length)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ErrNotRecording
+	}
+
+	reader := &RecordingReader{r: br}
+	if err := json.Unmarshal(header, &reader.Header); err != nil {
+		return nil, ErrNotRecording
+	}
+
+	return reader, nil
+}
+
+// Next returns the next frame of the recording, or io.EOF after the last.
+// Recordings which were cut off, like when wsplice crashed, end with
+// io.ErrUnexpectedEOF, and frames too long to have been recorded give
+// ErrNotRecording.
+func (r *RecordingReader) Next() (RecordedFrame, error) {
+	elapsed, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return RecordedFrame{}, err
+	}
+
+	var (
+		flags  byte
+		index  uint16
+		length uint64
+	)
+	if flags, err = r.r.ReadByte(); err == nil {
+		if err = binary.Read(r.r, binary.BigEndian, &index); err == nil {
+			length, err = binary.ReadUvarint(r.r)
+		}
+	}
+	if err != nil {
+		return RecordedFrame{}, io.ErrUnexpectedEOF
+	}
+	if length > maxRecordedFrameSize {
+		return RecordedFrame{}, ErrNotRecording
+	}
+	// The payload grows as it's read, rather than being allocated up front,
+	// so a cut off frame only costs what was written of it.
+	payload := bytes.NewBuffer(nil)
+	if _, err := io.CopyN(payload, r.r, int64(length)); err != nil {
+		return RecordedFrame{}, io.ErrUnexpectedEOF
+	}
+
+	frame := RecordedFrame{
+		Time:      time.Duration(elapsed),
+		Direction: ClientToRemote,
+		Index:     int(index),
+		OpCode:    ws.OpCode(flags & 0x0f),
+		Fin:       flags&0x40 != 0,
+		Payload:   payload.Bytes(),
+	}
+	if flags&0x80 != 0 {
+		frame.Direction = RemoteToClient
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,138 @@
+package wsplice
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (e *EndToEndSuite) TestRecordsSessions() {
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(e.T(), err)
+	defer os.RemoveAll(dir)
+	e.server.Recorder = &Recorder{Dir: dir, SampleRate: 1}
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"hello"`)
+	e.expectRead(cnx, 0, `"hello"`)
+	cnx.Close()
+	require.Eventually(e.T(), func() bool { return len(e.server.Sessions()) == 0 }, time.Second, 10*time.Millisecond)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.wsrec"))
+	require.Nil(e.T(), err)
+	require.Len(e.T(), files, 1)
+	file, err := os.Open(files[0])
+	require.Nil(e.T(), err)
+	defer file.Close()
+
+	reader, err := NewRecordingReader(file)
+	require.Nil(e.T(), err)
+	assert.Equal(e.T(), filepath.Join(dir, reader.Header.SessionID+".wsrec"), files[0])
+
+	var frames []RecordedFrame
+	for {
+		frame, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		require.Nil(e.T(), err)
+		frames = append(frames, frame)
+	}
+	require.Len(e.T(), frames, 4)
+	expected := []struct {
+		direction Direction
+		index     int
+		payload   string
+	}{
+		{ClientToRemote, controlIndex, `{"id":1,"type":"method","method":"connect","params":{"url":"` + url + `"}}`},
+		{RemoteToClient, controlIndex, `{"id":1,"type":"reply","result":{"index":0}}`},
+		{ClientToRemote, 0, `"hello"`},
+		{RemoteToClient, 0, `"hello"`},
+	}
+	for i, frame := range frames {
+		assert.Equal(e.T(), expected[i].direction, frame.Direction)
+		assert.Equal(e.T(), expected[i].index, frame.Index)
+		assert.True(e.T(), frame.Fin)
+		assert.Equal(e.T(), expected[i].payload, string(frame.Payload))
+		if i > 0 {
+			assert.True(e.T(), frame.Time >= frames[i-1].Time)
+		}
+	}
+	assert.Equal(e.T(), ws.OpCode(ws.OpBinary), frames[0].OpCode)
+}
+
+func (e *EndToEndSuite) TestLimitsRecordedFrames() {
+	dir, err := ioutil.TempDir("", "wsplice")
+	require.Nil(e.T(), err)
+	defer os.RemoveAll(dir)
+	e.server.Recorder = &Recorder{Dir: dir, SampleRate: 1}
+	big := `"` + strings.Repeat("a", 600*1024) + `"`
+	url := e.makeUpgradeServer(func(c *websocket.Conn, r *http.Request) {
+		c.WriteMessage(websocket.TextMessage, []byte(big))
+		c.ReadMessage()
+	})
+
+	// Remote servers sending frames which are too long are disconnected.
+	cnx := e.connectSocket()
+	defer cnx.Close()
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1009,"reason":"","index":0}}`)
+
+	// As are clients.
+	dialer := websocket.Dialer{WriteBufferSize: 1024 * 1024}
+	client, _, err := dialer.Dial("ws:"+e.wspliceServer.URL[5:], nil)
+	require.Nil(e.T(), err)
+	defer client.Close()
+	client.WriteMessage(websocket.BinaryMessage, append(getIndexPrefix(0xffff), big...))
+	_, _, err = client.ReadMessage()
+	require.True(e.T(), websocket.IsCloseError(err, websocket.CloseMessageTooBig), "expected a close error, got %v", err)
+}
+
+func TestPicksSessionsToRecord(t *testing.T) {
+	recorder := &Recorder{Identities: []string{"*.example.com"}}
+	assert.True(t, recorder.records("client.example.com"))
+	assert.False(t, recorder.records("client.example.org"))
+	assert.False(t, recorder.records(""))
+	recorder.SampleRate = 1
+	assert.True(t, recorder.records(""))
+}
+
+func TestRejectsCorruptRecordings(t *testing.T) {
+	uvarint := func(v uint64) []byte {
+		buf := make([]byte, binary.MaxVarintLen64)
+		return buf[:binary.PutUvarint(buf, v)]
+	}
+	recording := func(parts ...[]byte) io.Reader {
+		return bytes.NewReader(bytes.Join(append([][]byte{[]byte(recordingMagic)}, parts...), nil))
+	}
+
+	_, err := NewRecordingReader(recording(uvarint(1<<62), []byte("{}")))
+	assert.Equal(t, ErrNotRecording, err)
+
+	frame := []byte{0x41, 0, 0}
+	reader, err := NewRecordingReader(recording(uvarint(2), []byte("{}"), uvarint(0), frame, uvarint(1<<62)))
+	require.Nil(t, err)
+	_, err = reader.Next()
+	assert.Equal(t, ErrNotRecording, err)
+
+	reader, err = NewRecordingReader(recording(uvarint(2), []byte("{}"), uvarint(0), frame, uvarint(1<<20), []byte("cut off")))
+	require.Nil(t, err)
+	_, err = reader.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,141 @@
+package wsplice
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// SessionInfo describes a client session and its traffic. "Sent" counters
+// refer to data coming from the client, and "received" counters to data
+// going back to it.
+type SessionInfo struct {
+	ID               string    `json:"id"`
+	RemoteAddr       string    `json:"remoteAddr"`
+	Identity         string    `json:"identity,omitempty"`
+	Subprotocol      string    `json:"subprotocol,omitempty"`
+	StartedAt        time.Time `json:"startedAt"`
+	Age              float64   `json:"age"` // in milliseconds
+	Connections      int       `json:"connections"`
+	SentBytes        int64     `json:"sentBytes"`
+	SentMessages     int64     `json:"sentMessages"`
+	ReceivedBytes    int64     `json:"receivedBytes"`
+	ReceivedMessages int64     `json:"receivedMessages"`
+	SentRate         float64   `json:"sentRate"`     // average bytes per second
+	ReceivedRate     float64   `json:"receivedRate"` // average bytes per second
+}
+
+// addSession adds the session to the server's registry.
+func (s *Server) addSession(session *Session) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if s.sessions == nil {
+		s.sessions = map[string]*Session{}
+	}
+	s.sessions[session.id] = session
+}
+
+// removeSession removes the session from the server's registry.
+func (s *Server) removeSession(session *Session) {
+	s.sessionsMu.Lock()
+	delete(s.sessions, session.id)
+	s.sessionsMu.Unlock()
+}
+
+// Session returns the running session with the ID, or nil.
+func (s *Server) Session(id string) *Session {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	return s.sessions[id]
+}
+
+// Sessions returns all running sessions, oldest first.
+func (s *Server) Sessions() []*Session {
+	s.sessionsMu.Lock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.sessionsMu.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].startedAt.Before(sessions[j].startedAt)
+	})
+
+	return sessions
+}
+
+// BroadcastNotice sends the message to every running session in a "notice"
+// call on its control channel. It returns the number of sessions notified.
+func (s *Server) BroadcastNotice(message string) int {
+	sessions := s.Sessions()
+	for _, session := range sessions {
+		session.SendMethod("notice", NoticeCommand{Message: message})
+	}
+
+	return len(sessions)
+}
+
+// ID returns the session's unique ID.
+func (s *Session) ID() string { return s.id }
+
+// Identity returns the common name of the client's certificate, if it
+// presented one.
+func (s *Session) Identity() string { return s.identity }
+
+// Info returns a snapshot of the session and its traffic statistics.
+func (s *Session) Info() SessionInfo {
+	s.connectionsMu.Lock()
+	connections := s.countConnections()
+	s.connectionsMu.Unlock()
+
+	age := time.Since(s.startedAt)
+	info := SessionInfo{
+		ID:               s.id,
+		RemoteAddr:       s.remoteAddr,
+		Identity:         s.identity,
+		Subprotocol:      s.subprotocol,
+		StartedAt:        s.startedAt,
+		Age:              durationMillis(age),
+		Connections:      connections,
+		SentBytes:        atomic.LoadInt64(&s.stats.sentBytes),
+		SentMessages:     atomic.LoadInt64(&s.stats.sentMessages),
+		ReceivedBytes:    atomic.LoadInt64(&s.stats.receivedBytes),
+		ReceivedMessages: atomic.LoadInt64(&s.stats.receivedMessages),
+	}
+	if seconds := age.Seconds(); seconds > 0 {
+		info.SentRate = float64(info.SentBytes) / seconds
+		info.ReceivedRate = float64(info.ReceivedBytes) / seconds
+	}
+
+	return info
+}
+
+// CloseWithReason closes the session, along with all its connections, with
+// the code and reason.
+func (s *Session) CloseWithReason(code ws.StatusCode, reason string) {
+	s.closeAll(code, reason)
+}
+
+// CloseConnection closes the connection at the index with the code and
+// reason, notifying the client as if the remote server had closed it. It
+// returns false if there's no connection at the index.
+func (s *Session) CloseConnection(index int, code ws.StatusCode, reason string) bool {
+	cnx := s.GetConnection(index)
+	if cnx == nil {
+		return false
+	}
+
+	// As when a connection goes idle, claim the notification first so the
+	// client hears the reason rather than a disconnect.
+	if cnx.claimSignal() {
+		cnx.Close(ws.NewCloseFrame(code, reason))
+		cnx.notifyClosed(code, reason)
+	}
+
+	return true
+}
@@ -0,0 +1,64 @@
+package wsplice
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// waitForSessions waits until the server has the number of sessions running.
+func (e *EndToEndSuite) waitForSessions(count int) []*Session {
+	require.Eventually(e.T(), func() bool { return len(e.server.Sessions()) == count }, time.Second, 5*time.Millisecond)
+	return e.server.Sessions()
+}
+
+func (e *EndToEndSuite) TestRegistersSessions() {
+	url := e.makeServer(echo)
+	cnx := e.connectSocket()
+	e.write(cnx, 0xffff, `{"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"reply","result":{"index":0}}`)
+
+	sessions := e.waitForSessions(1)
+	require.Equal(e.T(), sessions[0], e.server.Session(sessions[0].ID()))
+	info := sessions[0].Info()
+	require.Equal(e.T(), 1, info.Connections)
+	require.Equal(e.T(), cnx.LocalAddr().String(), info.RemoteAddr)
+
+	cnx.Close()
+	e.waitForSessions(0)
+	require.Nil(e.T(), e.server.Session(info.ID))
+}
+
+func (e *EndToEndSuite) TestClosesSessionsByID() {
+	cnx := e.connectSocket()
+	sessions := e.waitForSessions(1)
+
+	sessions[0].CloseWithReason(4321, "bye")
+	_, _, err := cnx.ReadMessage()
+	require.Equal(e.T(), &websocket.CloseError{Code: 4321, Text: "bye"}, err)
+	e.waitForSessions(0)
+}
+
+func (e *EndToEndSuite) TestClosesConnectionsByIndex() {
+	url := e.makeServer(echo)
+	cnx := e.connectSocket()
+	e.write(cnx, 0xffff, `{"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"reply","result":{"index":0}}`)
+
+	session := e.waitForSessions(1)[0]
+	require.False(e.T(), session.CloseConnection(1, 4000, "nope"))
+	require.True(e.T(), session.CloseConnection(0, 4321, "bye"))
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":4321,"reason":"bye","index":0}}`)
+	require.Empty(e.T(), session.ListConnections())
+}
+
+func (e *EndToEndSuite) TestBroadcastsNotices() {
+	first := e.connectSocket()
+	second := e.connectSocket()
+	e.waitForSessions(2)
+
+	require.Equal(e.T(), 2, e.server.BroadcastNotice("restarting soon"))
+	e.expectRead(first, 0xffff, `{"id":0,"type":"method","method":"notice","params":{"message":"restarting soon"}}`)
+	e.expectRead(second, 0xffff, `{"id":0,"type":"method","method":"notice","params":{"message":"restarting soon"}}`)
+}
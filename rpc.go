@@ -6,19 +6,25 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"io"
 
 	"github.com/gobwas/ws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-type methodMap map[string]func(json.RawMessage) (interface{}, error)
+type methodMap map[string]func(context.Context, json.RawMessage) (interface{}, error)
 
 // RPC implements a simple bidirectional RPC server.
 type RPC struct {
 	config  *Config
+	tracer  trace.Tracer
 	methods methodMap
 }
 
@@ -34,119 +40,284 @@ func (r *RPC) ReadMethodCall(sr io.Reader) (Method, error) {
 }
 
 // Dispatch sends a method call to the correct handler, return the packet to
-// reply with, or an error.
-func (r *RPC) Dispatch(method Method) (v interface{}, err error) {
+// reply with, or an error. The call is traced in a span that's a child of
+// the context's span.
+func (r *RPC) Dispatch(ctx context.Context, method Method) (v interface{}, err error) {
 	// Currently, we don't care about replies at all.
 	if method.Type == "reply" {
 		return nil, nil
 	}
+
+	ctx, span := r.tracer.Start(ctx, "wsplice.rpc "+method.Method, trace.WithAttributes(
+		attribute.String("rpc.method", method.Method),
+		attribute.Int("wsplice.rpc_id", method.ID),
+	))
+	defer func() { endSpan(span, err) }()
+
 	handler := r.methods[method.Method]
 	reply := Reply{ID: method.ID, Type: "reply"}
 	if handler == nil {
 		reply.Error = UnknownMethod.ResponseError()
 	} else {
-		reply.Result, err = handler(method.Params)
+		reply.Result, err = handler(ctx, method.Params)
 	}
 
 	if rerr, ok := err.(*ResponseError); ok {
 		reply.Error = rerr
 		err = nil
 	}
+	if reply.Error != nil {
+		span.SetStatus(codes.Error, reply.Error.Message)
+	}
 
 	return reply, err
 }
 
-// dialConnection executes a dial connection command. It errors if the host to
-// dial to is not in the allowed list of hostnames.
-func (s *Session) dialConnection(cmd ConnectCommand) (net.Conn, error) {
-	targetUrl, err := url.Parse(cmd.URL)
+// afterReply wraps a method result with a function that's run once its reply
+// has been sent to the client.
+type afterReply struct {
+	result interface{}
+	fn     func()
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a afterReply) MarshalJSON() ([]byte, error) { return json.Marshal(a.result) }
+
+// runAfterReply runs the afterReply function of the reply's result, if any.
+func runAfterReply(data interface{}) {
+	if reply, ok := data.(Reply); ok {
+		if after, ok := reply.Result.(afterReply); ok {
+			after.fn()
+		}
+	}
+}
+
+// checkURL returns an error if the client is not allowed to dial the URL.
+// URLs served by the server's Handlers are always allowed.
+func (s *Session) checkURL(rawURL string) error {
+	targetUrl, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, InvalidURL
+		return InvalidURL
+	}
+	if s.server.handler(rawURL) != nil {
+		return nil
 	}
 
-	if len(s.config.HostnameAllowlist) > 0 {
+	allowlist := s.dialConfig().HostnameAllowlist
+	if len(allowlist) > 0 {
 		var allowed bool
-		for _, hostname := range s.config.HostnameAllowlist {
+		for _, hostname := range allowlist {
 			if strings.ToLower(hostname) == strings.ToLower(targetUrl.Hostname()) {
 				allowed = true
 				break
 			}
 		}
 		if !allowed {
-			return nil, InvalidHostname.WithPath("url")
+			return InvalidHostname.WithPath("url")
 		}
 	}
 
-	headers := http.Header{}
-	for key, value := range cmd.Headers {
-		headers.Set(key, value)
+	return nil
+}
+
+// checkForwardHeaders returns an error if the client asked to forward an
+// upgrade request header which isn't forwardable.
+func (s *Session) checkForwardHeaders(names []string) error {
+	forwardable := s.dialConfig().ForwardableHeaders
+	for i, name := range names {
+		var allowed bool
+		for _, header := range forwardable {
+			if http.CanonicalHeaderKey(header) == http.CanonicalHeaderKey(name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return HeaderNotForwardable.WithPath("forwardHeaders", strconv.Itoa(i))
+		}
 	}
 
+	return nil
+}
+
+// dialConnection executes a dial connection command. It errors if the host to
+// dial to is not in the allowed list of hostnames. The trace context is
+// passed on to the remote server in the request headers.
+func (s *Session) dialConnection(ctx context.Context, cmd ConnectCommand) (conn net.Conn, resp ws.Response, err error) {
+	ctx, span := s.tracer.Start(ctx, "wsplice.dial",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("url.full", tracedURL(cmd.URL))),
+	)
+	defer func() {
+		span.SetAttributes(attribute.String("wsplice.subprotocol", resp.Protocol))
+		endSpan(span, err)
+	}()
+
+	if cmd.upstream == nil {
+		if err := s.checkURL(cmd.URL); err != nil {
+			return nil, ws.Response{}, err
+		}
+	}
+
+	headers := s.dialHeaders(cmd)
+	s.propagator.Inject(ctx, propagation.HeaderCarrier(headers))
+
 	// Set the dial timeout to what the socket asks for, up to a maximum of
-	// the global dial timeout. Default to 10 seconds.
+	// the upstream's or the global dial timeout. Default to 10 seconds.
 	var timeout time.Duration
 	if cmd.Timeout > 0 {
 		timeout = time.Millisecond * time.Duration(cmd.Timeout)
 	}
-	if timeout == 0 || (s.config.DialTimeout > 0 && timeout > s.config.DialTimeout) {
-		timeout = s.config.DialTimeout
+	limit := s.dialConfig().DialTimeout
+	if cmd.upstream != nil && cmd.upstream.DialTimeout > 0 {
+		limit = cmd.upstream.DialTimeout
+	}
+	if timeout == 0 || (limit > 0 && timeout > limit) {
+		timeout = limit
 	}
 	if timeout == 0 {
 		timeout = 10 * time.Second
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	// URLs served in this process aren't dialed at all.
+	if handler := s.server.handler(cmd.URL); handler != nil {
+		span.AddEvent("handler")
+		return s.dialHandler(handler, cmd.URL, headers), ws.Response{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	conn, _, err := ws.Dialer{Protocol: cmd.Subprotocols}.Dial(ctx, cmd.URL, headers)
-	return conn, err
+	dialer := ws.Dialer{Protocol: cmd.Subprotocols}
+	if cmd.upstream != nil {
+		dialer.TLSConfig = cmd.upstream.TLSConfig
+	}
+	if cmd.upstream != nil && len(cmd.upstream.Backends) > 0 {
+		return cmd.upstream.getPool().dial(ctx, cmd, func(url string) (net.Conn, ws.Response, error) {
+			span.AddEvent("dial backend", trace.WithAttributes(attribute.String("url.full", tracedURL(url))))
+			return dialer.Dial(ctx, url, headers)
+		})
+	}
+	return dialer.Dial(ctx, cmd.URL, headers)
 }
 
-// insertConnection adds the net.Conn, as a websocket connection, into the
-// connection list and returns the index it was inserted it.
-func (s *Session) insertConnection(conn net.Conn) (index int) {
-	cnx := &Connection{
-		session: s,
-		socket:  NewSocket(conn, s.config),
-		config:  s.config,
+// dialHeaders returns the headers to send to the remote server: those the
+// client gave, those it forwarded from its upgrade request, and its Origin.
+func (s *Session) dialHeaders(cmd ConnectCommand) http.Header {
+	headers := http.Header{}
+	for key, value := range cmd.Headers {
+		headers.Set(key, value)
 	}
-
-	s.connectionsMu.Lock()
-	defer s.connectionsMu.Unlock()
-
-	defer func() {
-		cnx.index = index
-		go cnx.Start()
-	}()
-
-	for i, cnx := range s.connections {
-		if cnx == nil {
-			index = i
-			s.connections[i] = cnx
-			return index
+	for _, name := range cmd.ForwardHeaders {
+		if values := s.upgradeHeader[http.CanonicalHeaderKey(name)]; len(values) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	s.server.AllowedOrigins.setUpstreamOrigin(headers, s.upgradeHeader.Get("Origin"))
+	// The upstream's own headers win over any the client forwards.
+	if cmd.upstream != nil {
+		for key, value := range cmd.upstream.Headers {
+			headers.Set(key, value)
 		}
 	}
 
-	index = len(s.connections)
-	s.connections = append(s.connections, cnx)
-	return index
+	return headers
 }
 
-func (s *Session) connect(params json.RawMessage) (interface{}, error) {
+func (s *Session) connect(ctx context.Context, params json.RawMessage) (interface{}, error) {
 	var parsed ConnectCommand
 	if err := json.Unmarshal(params, &parsed); err != nil {
 		return nil, BadJSON
 	}
+	if err := s.checkForwardHeaders(parsed.ForwardHeaders); err != nil {
+		return nil, err
+	}
+	if err := s.resolveTarget(&parsed); err != nil {
+		return nil, err
+	}
 
-	conn, err := s.dialConnection(parsed)
+	if parsed.Shared {
+		return s.connectShared(ctx, parsed)
+	}
+	if parsed.Async {
+		return s.connectAsync(ctx, parsed)
+	}
+
+	// Check the requested index up front so that we don't dial needlessly.
+	// It's checked again when it's inserted, in case it was taken while
+	// we were dialing.
+	if parsed.Index != nil && !s.IndexAvailable(*parsed.Index) {
+		return nil, IndexInUse.WithPath("index")
+	}
+
+	conn, resp, err := s.dialConnection(ctx, parsed)
+	if err != nil {
+		return nil, &ResponseError{Code: DialError, Message: dialErrorMessage(parsed, err), Path: "url"}
+	}
+
+	cnx := newConnection(ctx, s, parsed)
+	cnx.open(NewClientSocket(conn, cnx.config), resp.Protocol)
+	index, err := s.insertConnection(cnx, parsed.Index)
 	if err != nil {
-		return nil, &ResponseError{Code: DialError, Message: err.Error(), Path: "url"}
+		conn.Close()
+		endSpan(cnx.span, err)
+		return nil, err
 	}
+	go cnx.Start()
 
-	index := s.insertConnection(conn)
 	return ConnectResponse{index}, nil
 }
 
-func (s *Session) terminate(params json.RawMessage) (interface{}, error) {
+// connectAsync reserves an index for the connection and replies with it right
+// away. The remote server is dialed once the reply has been sent, so that the
+// client always knows the index before it gets any events for it.
+func (s *Session) connectAsync(ctx context.Context, cmd ConnectCommand) (interface{}, error) {
+	if cmd.upstream == nil {
+		if err := s.checkURL(cmd.URL); err != nil {
+			return nil, &ResponseError{Code: DialError, Message: err.Error(), Path: "url"}
+		}
+	}
+
+	// The dial outlives the RPC call, so it's only cancelled when the
+	// connection is, but it's still traced as part of the call.
+	cnx := newConnection(ctx, s, cmd)
+	ctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), cnx.span))
+	cnx.cancelDial = cancel
+	index, err := s.insertConnection(cnx, cmd.Index)
+	if err != nil {
+		cancel()
+		endSpan(cnx.span, err)
+		return nil, err
+	}
+
+	return afterReply{ConnectResponse{index}, func() { go s.dialAsync(ctx, cnx, cmd) }}, nil
+}
+
+// dialAsync dials the remote server for a connection created by connectAsync,
+// notifying the client whether it succeeded.
+func (s *Session) dialAsync(ctx context.Context, cnx *Connection, cmd ConnectCommand) {
+	conn, resp, err := s.dialConnection(ctx, cmd)
+	if err != nil {
+		// If the client terminated the connection while we were dialing
+		// it, there's nothing to tell them.
+		if cnx.State() == StateConnecting {
+			cnx.signalClosed(ws.StatusAbnormalClosure, dialErrorMessage(cmd, err))
+		} else {
+			cnx.span.End()
+		}
+		return
+	}
+
+	if !cnx.open(NewClientSocket(conn, cnx.config), resp.Protocol) {
+		conn.Close()
+		cnx.span.End()
+		return
+	}
+
+	s.SendMethod("onSocketOpen", SocketOpenCommand{Index: cnx.index, Subprotocol: resp.Protocol})
+	cnx.Start()
+}
+
+func (s *Session) terminate(_ context.Context, params json.RawMessage) (interface{}, error) {
 	var parsed TerminateCommand
 	if err := json.Unmarshal(params, &parsed); err != nil {
 		return nil, BadJSON
@@ -155,3 +326,25 @@ func (s *Session) terminate(params json.RawMessage) (interface{}, error) {
 	s.RemoveConnection(parsed.Index)
 	return TerminateResponse{}, nil
 }
+
+func (s *Session) listConnections(_ context.Context, params json.RawMessage) (interface{}, error) {
+	var parsed ListConnectionsCommand
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &parsed); err != nil {
+			return nil, BadJSON
+		}
+	}
+
+	// Clients don't need to know the URLs of the targets they connected to.
+	connections := s.ListConnections()
+	for i := range connections {
+		if connections[i].Target != "" {
+			connections[i].URL = ""
+		}
+	}
+
+	return ListConnectionsResponse{
+		Connections: connections,
+		RTT:         durationMillis(s.RTT()),
+	}, nil
+}
@@ -0,0 +1,57 @@
+package wsplice
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/gobwas/ws"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// validate checks a message the client sent against the connection's
+// schema, returning an InvalidPayload error if it doesn't match. Binary
+// messages are checked as well as text ones, since clients usually send
+// their index prefixes in binary frames. The error's path points to the part
+// of the message which failed, like "items.0.name".
+func (c *Connection) validate(opCode ws.OpCode, payload []byte) *ResponseError {
+	if c.schema == nil || (opCode != ws.OpText && opCode != ws.OpBinary) {
+		return nil
+	}
+
+	if !json.Valid(payload) {
+		return c.invalidPayload("", "the message is not valid JSON")
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	decoder.Decode(&value)
+	err := c.schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return c.invalidPayload("", err.Error())
+	}
+	// Report the innermost cause, which says which value was wrong rather
+	// than just that some subschema failed.
+	for len(verr.Causes) > 0 {
+		verr = verr.Causes[0]
+	}
+	path := strings.Replace(strings.TrimPrefix(verr.InstanceLocation, "/"), "/", ".", -1)
+
+	return c.invalidPayload(path, verr.Message)
+}
+
+// invalidPayload returns an InvalidPayload error for the connection.
+func (c *Connection) invalidPayload(path, reason string) *ResponseError {
+	index := c.index
+	return &ResponseError{
+		Code:    InvalidPayload,
+		Message: InvalidPayload.Error() + ": " + reason,
+		Path:    path,
+		Index:   &index,
+	}
+}
@@ -0,0 +1,49 @@
+package wsplice
+
+import (
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func (e *EndToEndSuite) TestValidatesMessagesToTargets() {
+	schema, err := jsonschema.CompileString("chat.json", `{
+		"type": "object",
+		"required": ["text"],
+		"properties": {
+			"text": {"type": "string", "maxLength": 300000},
+			"tags": {"type": "array", "items": {"type": "string"}}
+		}
+	}`)
+	require.Nil(e.T(), err)
+	url := e.makeServer(forever(echo))
+	e.config.Upstreams = map[string]*Upstream{
+		"chat":  {URL: url, Schema: schema},
+		"plain": {URL: url},
+	}
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"target":"chat"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"connect","params":{"target":"plain"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","result":{"index":1}}`)
+
+	e.write(cnx, 0, `{"tags":[]}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4019,`+
+		`"message":"The message does not match the target's schema: missing properties: 'text'","index":0}}`)
+	e.write(cnx, 0, `{"text":"hi","tags":["a",5]}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4019,`+
+		`"message":"The message does not match the target's schema: expected string, but got number","path":"tags.1","index":0}}`)
+	e.write(cnx, 0, `[1,`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4019,`+
+		`"message":"The message does not match the target's schema: the message is not valid JSON","index":0}}`)
+	e.write(cnx, 1, `[1,`)
+	e.expectRead(cnx, 1, `[1,`)
+
+	// Fragmented messages are validated whole.
+	message := `{"text":"` + strings.Repeat("a", 200*1024) + `"}`
+	e.write(cnx, 0, message)
+	e.expectRead(cnx, 0, message)
+}
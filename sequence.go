@@ -0,0 +1,176 @@
+package wsplice
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"sync"
+
+	"github.com/gobwas/ws"
+)
+
+// sequenceBytesSize is the size of the sequence numbers which follow the
+// index on messages sent on sequenced connections.
+const sequenceBytesSize = 8
+
+// sequencer numbers the messages sent to the client on a sequenced
+// connection, and retains those it hasn't acknowledged so that they can be
+// resent.
+type sequencer struct {
+	mu         sync.Mutex
+	limit      int
+	bytesLimit int64
+	// last is the sequence number of the last message sent.
+	last uint64
+	// retained are the unacknowledged messages, oldest first, and size is
+	// the total length of their payloads.
+	retained []sequencedMessage
+	size     int64
+}
+
+type sequencedMessage struct {
+	sequence uint64
+	opCode   ws.OpCode
+	payload  []byte
+}
+
+// newSequencer creates a sequencer which retains up to the config's
+// RetransmitLimit messages, and up to its RetransmitBytes of them.
+func newSequencer(config *Config) *sequencer {
+	limit := config.RetransmitLimit
+	if limit <= 0 {
+		limit = defaultRetransmitLimit
+	}
+	bytesLimit := config.RetransmitBytes
+	if bytesLimit <= 0 {
+		bytesLimit = defaultRetransmitBytes
+	}
+
+	return &sequencer{limit: limit, bytesLimit: bytesLimit}
+}
+
+// send numbers the message and sends it to the client. If more messages,
+// or more bytes of them, than the limits are unacknowledged, the oldest are
+// no longer retained.
+func (s *sequencer) send(session *Session, index int, msg InterceptedMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.last++
+	m := sequencedMessage{sequence: s.last, opCode: msg.OpCode, payload: msg.Payload}
+	s.retained = append(s.retained, m)
+	s.size += int64(len(m.payload))
+	i, size := 0, s.size
+	for len(s.retained)-i > s.limit || (i < len(s.retained) && size > s.bytesLimit) {
+		size -= int64(len(s.retained[i].payload))
+		i++
+	}
+	s.drop(i)
+
+	return m.send(session, index)
+}
+
+// drop stops retaining the oldest n messages.
+func (s *sequencer) drop(n int) {
+	for _, m := range s.retained[:n] {
+		s.size -= int64(len(m.payload))
+	}
+	s.retained = append(s.retained[:0], s.retained[n:]...)
+}
+
+// ack stops retaining the messages up to and including the sequence number.
+func (s *sequencer) ack(sequence uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.retained) && s.retained[i].sequence <= sequence {
+		i++
+	}
+	s.drop(i)
+}
+
+// resend sends the client the messages from the sequence number on again,
+// before any newer ones. It returns SequenceUnavailable if any of them
+// aren't retained.
+func (s *sequencer) resend(session *Session, index int, from uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if from == 0 {
+		from = 1
+	}
+	if from > s.last {
+		return nil
+	}
+	if len(s.retained) == 0 || s.retained[0].sequence > from {
+		return SequenceUnavailable
+	}
+	for _, m := range s.retained[from-s.retained[0].sequence:] {
+		if err := m.send(session, index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send writes the message to the client with its sequence number between
+// the index and the payload.
+func (m sequencedMessage) send(session *Session, index int) error {
+	b := make([]byte, sequenceBytesSize+len(m.payload))
+	binary.BigEndian.PutUint64(b, m.sequence)
+	copy(b[sequenceBytesSize:], m.payload)
+
+	return session.WriteIndexedData(index, ws.Header{Fin: true, OpCode: m.opCode}, b)
+}
+
+// sequenced returns the session's connection at the index, if it's
+// sequenced.
+func (s *Session) sequenced(index int) (*Connection, error) {
+	cnx := s.GetConnection(index)
+	if cnx == nil {
+		return nil, UnknownConnection.WithPath("index")
+	}
+	if cnx.sequence == nil {
+		return nil, NotSequenced.WithPath("index")
+	}
+
+	return cnx, nil
+}
+
+// ack handles the "ack" method, which acknowledges the messages a sequenced
+// connection has sent up to a sequence number.
+func (s *Session) ack(_ context.Context, params json.RawMessage) (interface{}, error) {
+	var parsed AckCommand
+	if err := json.Unmarshal(params, &parsed); err != nil {
+		return nil, BadJSON
+	}
+	cnx, err := s.sequenced(parsed.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	cnx.sequence.ack(parsed.Sequence)
+	return AckResponse{}, nil
+}
+
+// resend handles the "resend" method, which sends the client the messages a
+// sequenced connection has sent from a sequence number on again.
+func (s *Session) resend(_ context.Context, params json.RawMessage) (interface{}, error) {
+	var parsed ResendCommand
+	if err := json.Unmarshal(params, &parsed); err != nil {
+		return nil, BadJSON
+	}
+	cnx, err := s.sequenced(parsed.Index)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cnx.sequence.resend(s, cnx.index, parsed.From); err == SequenceUnavailable {
+		return nil, SequenceUnavailable.WithPath("from")
+	} else if err != nil {
+		return nil, err
+	}
+	return ResendResponse{}, nil
+}
@@ -0,0 +1,85 @@
+package wsplice
+
+import (
+	"encoding/binary"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// expectSequenced reads a message sent on a sequenced connection.
+func (e *EndToEndSuite) expectSequenced(cnx *websocket.Conn, index int, sequence uint64, expected string) {
+	_, b, err := cnx.ReadMessage()
+	e.expectNoerr(err)
+	require.True(e.T(), len(b) >= indexBytesSize+sequenceBytesSize, "Got a message too short to be sequenced: %s", b)
+	require.Equal(e.T(), getIndexPrefix(index), b[:indexBytesSize])
+	require.Equal(e.T(), sequence, binary.BigEndian.Uint64(b[indexBytesSize:]))
+	require.Equal(e.T(), expected, string(b[indexBytesSize+sequenceBytesSize:]))
+}
+
+func (e *EndToEndSuite) TestSequencesMessages() {
+	e.config.RetransmitLimit = 3
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","sequenced":true}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	for i, message := range []string{`"a"`, `"b"`, `"c"`, `"d"`} {
+		e.write(cnx, 0, message)
+		e.expectSequenced(cnx, 0, uint64(i+1), message)
+	}
+
+	// Only the last three messages are retained.
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"resend","params":{"index":0,"from":1}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","error":{"code":4021,"message":"Those messages are no longer retained","path":"from"}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"resend","params":{"index":0,"from":3}}`)
+	e.expectSequenced(cnx, 0, 3, `"c"`)
+	e.expectSequenced(cnx, 0, 4, `"d"`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","result":{}}`)
+
+	e.write(cnx, 0xffff, `{"id":4,"type":"method","method":"ack","params":{"index":0,"sequence":3}}`)
+	e.expectRead(cnx, 0xffff, `{"id":4,"type":"reply","result":{}}`)
+	e.write(cnx, 0xffff, `{"id":5,"type":"method","method":"resend","params":{"index":0,"from":3}}`)
+	e.expectRead(cnx, 0xffff, `{"id":5,"type":"reply","error":{"code":4021,"message":"Those messages are no longer retained","path":"from"}}`)
+	e.write(cnx, 0xffff, `{"id":6,"type":"method","method":"resend","params":{"index":0,"from":5}}`)
+	e.expectRead(cnx, 0xffff, `{"id":6,"type":"reply","result":{}}`)
+}
+
+func (e *EndToEndSuite) TestLimitsRetainedBytes() {
+	e.config.RetransmitBytes = 8
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","sequenced":true}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	for i, message := range []string{`"aa"`, `"bb"`, `"cc"`} {
+		e.write(cnx, 0, message)
+		e.expectSequenced(cnx, 0, uint64(i+1), message)
+	}
+
+	// Only the last two messages fit in eight bytes.
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"resend","params":{"index":0,"from":1}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","error":{"code":4021,"message":"Those messages are no longer retained","path":"from"}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"resend","params":{"index":0,"from":2}}`)
+	e.expectSequenced(cnx, 0, 2, `"bb"`)
+	e.expectSequenced(cnx, 0, 3, `"cc"`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","result":{}}`)
+}
+
+func (e *EndToEndSuite) TestRequiresSequencedConnections() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"a"`)
+	e.expectRead(cnx, 0, `"a"`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"ack","params":{"index":0,"sequence":1}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","error":{"code":4020,"message":"That connection does not have sequence numbers","path":"index"}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"resend","params":{"index":1,"from":1}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","error":{"code":4004,"message":"You are trying to send to a connection which does not exist","path":"index"}}`)
+}
@@ -1,19 +1,26 @@
 package wsplice
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"io/ioutil"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/gobwas/ws"
 	"github.com/mixer/go-ext/msync"
 	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
@@ -28,52 +35,256 @@ const (
 	// copyBufferSize is the size of the byte rawBuffer to use for io.CopyBuffered
 	// operations.
 	copyBufferSize = 32 * 1024
+	// defaultConnectQueueLimit is the number of frames that may be queued
+	// for a connection that's still being dialed, if the Config doesn't
+	// specify a limit.
+	defaultConnectQueueLimit = 64
+	// defaultConnectQueueBytes is the number of bytes that may be queued
+	// for a connection that's still being dialed, if the Config doesn't
+	// specify a limit.
+	defaultConnectQueueBytes = 1 << 20
+	// defaultRetransmitLimit is the number of unacknowledged messages
+	// retained for sequenced connections, if the Config doesn't specify a
+	// limit.
+	defaultRetransmitLimit = 256
+	// defaultRetransmitBytes is the total size of the unacknowledged
+	// messages retained for sequenced connections, if the Config doesn't
+	// specify a limit.
+	defaultRetransmitBytes = 4 << 20
 )
 
 type Server struct {
 	Config *Config
+
+	// AccessLog, if set, records every session and remote connection once
+	// they end.
+	AccessLog AccessLogger
+
+	// TracerProvider creates the spans for sessions, RPC calls and remote
+	// connections. If nil, the global OpenTelemetry provider is used.
+	TracerProvider trace.TracerProvider
+
+	// Propagator reads trace context from clients' upgrade requests and
+	// adds it to requests dialing remote servers. If nil, W3C Trace
+	// Context headers are used.
+	Propagator propagation.TextMapPropagator
+
+	// ReadinessChecks are the dependencies, such as a canary upstream, which
+	// must be healthy for the server to be ready. See Readiness.
+	ReadinessChecks []ReadinessCheck
+
+	// AllowedOrigins, if set, decides which browser origins may open
+	// sessions, and the Origin sent to remote servers. Clients from other
+	// origins get a 403 response. If nil, every origin is allowed.
+	AllowedOrigins *OriginPolicy
+
+	// Broker, if set, lets clients subscribe and publish to topics with the
+	// "subscribe" method, subject to the Config's TopicRules.
+	Broker Broker
+
+	// Recorder, if set, records the sessions it picks to files.
+	Recorder *Recorder
+
+	// EventStreams lets clients which can't open websockets start sessions
+	// with a GET request for Server-Sent Events, which carry the messages
+	// the session sends, and send messages with POST requests.
+	EventStreams bool
+
+	// draining is set to 1 once the server starts to drain, accessed
+	// atomically.
+	draining int32
+
+	// reloaded holds the *Config given to SetConfig, if any.
+	reloaded atomic.Value
+
+	sessionsMu sync.Mutex
+	sessions   map[string]*Session
+
+	// handlers serve URLs in this process, registered with Handle.
+	handlersMu sync.RWMutex
+	handlers   map[string]Handler
+
+	// interceptors are registered with Intercept, by direction.
+	interceptorsMu sync.RWMutex
+	interceptors   map[Direction][]Interceptor
+
+	// methods are the control methods registered with RegisterMethod.
+	methodsMu sync.RWMutex
+	methods   map[string]MethodHandler
+
+	// shared holds the upstreams connected to with "shared": true, by
+	// their sharedKey.
+	sharedMu sync.Mutex
+	shared   map[string]*sharedUpstream
+
+	// eventStreams are the open event streams, by their tokens.
+	eventStreamsMu sync.Mutex
+	eventStreams   map[string]*eventStream
 }
 
 func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-	conn, _, _, err := ws.UpgradeHTTP(r, rw, r.Header)
+	// Messages for running event streams are still taken while draining,
+	// which leaves their sessions alone like any others.
+	if s.Draining() && !s.postsToEventStream(r) {
+		http.Error(rw, ErrDraining.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if origin := r.Header.Get("Origin"); !s.AllowedOrigins.Allows(origin) {
+		logrus.WithField("origin", origin).Debug("Rejected session from disallowed origin")
+		http.Error(rw, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if s.EventStreams && isEventStreamRequest(r) {
+		s.serveEventStream(rw, r)
+		return
+	}
+
+	upgrader := ws.HTTPUpgrader{Protocol: supportsSubprotocol}
+	conn, _, handshake, err := upgrader.Upgrade(r, rw, nil)
 	if err != nil {
 		return // ws will have written out the error to the http response
 	}
 
-	s.ServeConn(conn)
+	ctx := s.propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx = context.WithValue(ctx, upgradeKey{}, upgrade{header: r.Header, subprotocol: handshake.Protocol})
+	s.ServeConnContext(ctx, conn)
 }
 
+// upgradeKey is the context key for the upgrade a session was started by.
+type upgradeKey struct{}
+
+// upgrade describes the HTTP request which was upgraded to a session.
+type upgrade struct {
+	header      http.Header
+	subprotocol string
+	// tls is the state of the request's TLS connection, for transports
+	// which aren't themselves TLS connections.
+	tls *tls.ConnectionState
+}
+
+// ServeConn runs a session on the websocket connection until it closes.
 func (s *Server) ServeConn(conn net.Conn) {
+	s.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext is like ServeConn, but the session's span is created
+// as a child of any span in the context.
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) {
+	s.serve(ctx, conn, websocketFraming{})
+}
+
+// serve runs a session on the connection, whose frames are delimited by the
+// framing, until it closes.
+func (s *Server) serve(ctx context.Context, conn net.Conn, framing framing) {
+	s.ServeTransport(ctx, newConnTransport(conn, framing))
+}
+
+// ServeTransport runs a session on the transport until it closes. Like
+// ServeConnContext, the session's span is created as a child of any span in
+// the context.
+func (s *Server) ServeTransport(ctx context.Context, transport Transport) {
+	tracer := s.tracer()
+	config := s.currentConfig()
 	session := &Session{
-		Socket:          *NewSocket(conn, s.Config),
+		server:          s,
 		id:              uuid.NewV4().String(),
-		config:          s.Config,
+		remoteAddr:      transport.RemoteAddr().String(),
+		startedAt:       time.Now(),
+		accessLog:       s.AccessLog,
+		config:          config,
 		readCopyBuffer:  make([]byte, copyBufferSize),
 		writeCopyBuffer: make([]byte, copyBufferSize),
-		connections:     []*Connection{},
-		rpc:             RPC{config: s.Config},
+		connections:     map[int]*Connection{},
+		freedIndices:    map[int]time.Time{},
+		tracer:          tracer,
+		propagator:      s.propagator(),
+		rpc:             RPC{config: config, tracer: tracer},
+	}
+	session.Socket.init(transport, config)
+	var state *tls.ConnectionState
+	if upgrade, ok := ctx.Value(upgradeKey{}).(upgrade); ok {
+		session.upgradeHeader = upgrade.header
+		session.subprotocol = upgrade.subprotocol
+		state = upgrade.tls
+	}
+	if tlsConn, ok := session.Conn.(*tls.Conn); ok {
+		connState := tlsConn.ConnectionState()
+		state = &connState
+	}
+	if state != nil {
+		session.tls = newTLSInfo(*state)
+		session.identity = identityFromTLS(*state)
+	}
+	if s.Recorder != nil && s.Recorder.records(session.identity) {
+		recording, err := s.Recorder.open(session)
+		if err != nil {
+			logrus.WithError(err).WithField("id", session.id).Warn("Error opening session recording")
+		} else {
+			session.recording = recording
+		}
 	}
 
 	session.rpc.methods = methodMap{
-		"connect":   session.connect,
-		"terminate": session.terminate,
+		"connect":         session.connect,
+		"terminate":       session.terminate,
+		"listConnections": session.listConnections,
+		"ack":             session.ack,
+		"resend":          session.resend,
+	}
+	if s.Broker != nil {
+		session.rpc.methods["subscribe"] = session.subscribe
 	}
+	session.addRegisteredMethods(session.rpc.methods)
+
+	s.addSession(session)
+	defer s.removeSession(session)
 
+	session.startSessionSpan(ctx)
 	session.Start()
+	session.endSessionSpan()
 }
 
 type Session struct {
+	stats        trafficStats
+	lastActivity int64 // unix nanoseconds, accessed atomically
+
 	Socket
 	socketSendMu sync.Mutex
 	id           string
+	server       *Server
 	config       *Config
 	rpc          RPC
 
+	remoteAddr    string
+	upgradeHeader http.Header
+	subprotocol   string
+	identity      string
+	tls           *TLSInfo
+	startedAt     time.Time
+	accessLog     AccessLogger
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	ctx        context.Context
+	span       trace.Span
+
+	closeOnce   sync.Once
+	closeCode   ws.StatusCode
+	closeReason string
+
 	readCopyBuffer  []byte
 	writeCopyBuffer []byte
 
 	connectionsMu sync.Mutex
-	connections   []*Connection
+	connections   map[int]*Connection
+	freedIndices  map[int]time.Time
+	prunedIndices int
+	nextIndex     int
+
+	idleTimer *time.Timer
+
+	// recording is set if the session is being recorded.
+	recording *recording
 }
 
 func (s *Session) Start() {
@@ -86,17 +297,37 @@ func (s *Session) Start() {
 		frameReader = &io.LimitedReader{R: s.Socket.Reader}
 	)
 
+	s.StartPinging(s.config.ClientPingInterval)
+	s.startIdleTimer()
+
 	for {
 		s.Reader.Discard(int(frameReader.N))
 
-		if header, err = s.ReadNextFrame(); err != nil {
+		if header, err = s.ReadNextFrame(); isTimeout(err) {
+			s.closeAll(ws.StatusAbnormalClosure, "Read timeout")
+			break
+		} else if err != nil {
 			s.closeAll(ws.StatusAbnormalClosure, "Invalid socket header")
 			break
 		}
 		frameReader.N = header.Length
+		frame := frameReader
+		if s.recording != nil {
+			if frame, err = s.recording.readClientFrame(header, frameReader, s.config.FrameSizeLimit); err == FrameTooLong {
+				s.closeAll(ws.StatusMessageTooBig, "")
+				break
+			} else if err != nil {
+				s.closeAll(ws.StatusAbnormalClosure, "")
+				break
+			}
+		}
+
+		if header.OpCode != ws.OpClose {
+			s.stats.countSent(header.Length, header.Fin)
+		}
 
 		if header.OpCode == ws.OpClose {
-			s.dispatchClose(header, frameReader)
+			s.dispatchClose(header, frame)
 			break
 		}
 
@@ -104,14 +335,14 @@ func (s *Session) Start() {
 			if target != nil {
 				target.Close()
 			}
-			target, err = s.createTarget(&header, frameReader)
+			target, err = s.createTarget(&header, frame)
 			if err != nil {
 				s.handleError(err)
 				continue
 			}
 		}
 
-		if err := target.Pull(header, &s.Socket, frameReader); err != nil {
+		if err := target.Pull(header, &s.Socket, frame); err != nil {
 			s.handleError(err)
 		}
 	}
@@ -120,8 +351,42 @@ func (s *Session) Start() {
 		target.Close()
 	}
 
+	s.stopIdleTimer()
+
 	logrus.WithFields(logrus.Fields{"id": s.id}).Infof("client session ended")
 	s.Close()
+	s.logSession()
+	if s.recording != nil {
+		s.recording.close()
+	}
+}
+
+// logSession writes the session to the access log.
+func (s *Session) logSession() {
+	if s.accessLog == nil {
+		return
+	}
+
+	s.accessLog.LogSession(SessionRecord{
+		SessionID:        s.id,
+		RemoteAddr:       s.remoteAddr,
+		Identity:         s.identity,
+		TLS:              s.tls,
+		StartedAt:        s.startedAt,
+		Duration:         durationMillis(time.Since(s.startedAt)),
+		SentBytes:        atomic.LoadInt64(&s.stats.sentBytes),
+		SentMessages:     atomic.LoadInt64(&s.stats.sentMessages),
+		ReceivedBytes:    atomic.LoadInt64(&s.stats.receivedBytes),
+		ReceivedMessages: atomic.LoadInt64(&s.stats.receivedMessages),
+		CloseCode:        int(s.closeCode),
+		CloseReason:      s.closeReason,
+	})
+}
+
+// setCloseStatus records why the session was closed. Only the first status
+// set is kept.
+func (s *Session) setCloseStatus(code ws.StatusCode, reason string) {
+	s.closeOnce.Do(func() { s.closeCode, s.closeReason = code, reason })
 }
 
 // readOpNumber reads the operation number off the upcoming websocket frame.
@@ -137,6 +402,7 @@ func (s *Session) createTarget(header *ws.Header, frame io.Reader) (Target, erro
 	index := int(binary.BigEndian.Uint16(opBytes[:]))
 
 	if index == controlIndex {
+		s.touch()
 		return NewRPCTarget(s.readCopyBuffer, s), nil
 	}
 
@@ -163,29 +429,30 @@ func (s *Session) dispatchClose(header ws.Header, frame *io.LimitedReader) {
 	}
 
 	ws.Cipher(payload, header.Mask, 0)
+	s.setCloseStatus(ws.ParseCloseFrameData(payload))
 	s.broadcast(ws.NewFrame(ws.OpClose, true, payload))
 }
 
 // closeAll closes all sockets, including the original client, with the code
 // and reason message.
 func (s *Session) closeAll(code ws.StatusCode, reason string) {
+	s.setCloseStatus(code, reason)
 	frame := ws.NewCloseFrame(code, reason)
 	s.WriteFrame(frame)
 	s.Socket.Close()
 
 	s.broadcast(ws.NewCloseFrame(code, reason))
 	s.connectionsMu.Lock()
-	s.connections = nil
+	s.connections = map[int]*Connection{}
 	s.connectionsMu.Unlock()
 }
 
 // broadcast sends the websocket frame out to all connections.
 func (s *Session) broadcast(frame ws.Frame) {
 	s.connectionsMu.Lock()
-	msync.Parallel(len(s.connections), defaultParallelism, func(i int) {
-		if s.connections[i] != nil {
-			s.connections[i].socket.WriteFrame(frame)
-		}
+	connections := s.sortedConnections()
+	msync.Parallel(len(connections), defaultParallelism, func(i int) {
+		connections[i].WriteFrame(frame)
 	})
 	s.connectionsMu.Unlock()
 }
@@ -197,13 +464,11 @@ func (s *Session) broadcastFatalError(err error) {
 	s.Close()
 
 	s.connectionsMu.Lock()
-	msync.Parallel(len(s.connections), defaultParallelism, func(i int) {
-		cnx := s.connections[i]
-		if cnx != nil {
-			cnx.Close(frame)
-		}
+	connections := s.sortedConnections()
+	msync.Parallel(len(connections), defaultParallelism, func(i int) {
+		connections[i].Close(frame)
 	})
-	s.connections = nil
+	s.connections = map[int]*Connection{}
 	s.connectionsMu.Unlock()
 }
 
@@ -231,23 +496,66 @@ func (s *Session) GetConnection(index int) *Connection {
 	s.connectionsMu.Lock()
 	defer s.connectionsMu.Unlock()
 
-	if index >= len(s.connections) {
-		return nil
+	return s.connections[index]
+}
+
+// countConnections returns the number of connections in the session.
+// connectionsMu must be held.
+func (s *Session) countConnections() int {
+	return len(s.connections)
+}
+
+// sortedConnections returns the session's connections, ordered by their
+// index. connectionsMu must be held.
+func (s *Session) sortedConnections() []*Connection {
+	connections := make([]*Connection, 0, len(s.connections))
+	for _, cnx := range s.connections {
+		connections = append(connections, cnx)
 	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].index < connections[j].index })
 
-	return s.connections[index]
+	return connections
+}
+
+// ListConnections returns information about all open connections, ordered
+// by their index.
+func (s *Session) ListConnections() []ConnectionInfo {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+
+	infos := []ConnectionInfo{}
+	for _, cnx := range s.sortedConnections() {
+		infos = append(infos, cnx.Info())
+	}
+
+	return infos
 }
 
+// RemoveConnection closes and removes the connection at the index, if any.
 func (s *Session) RemoveConnection(index int) {
 	s.connectionsMu.Lock()
 	defer s.connectionsMu.Unlock()
 
-	if index >= len(s.connections) || s.connections[index] == nil {
+	cnx := s.connections[index]
+	if cnx == nil {
 		return
 	}
 
-	s.connections[index].socket.Close()
-	s.connections[index] = nil
+	cnx.close()
+	s.freeIndex(index)
+}
+
+// removeConnection closes and removes the connection, if it's still in the
+// connection list. Unlike RemoveConnection, it never removes a different
+// connection which has since been inserted at the same index.
+func (s *Session) removeConnection(cnx *Connection) {
+	s.connectionsMu.Lock()
+	defer s.connectionsMu.Unlock()
+
+	cnx.close()
+	if s.connections[cnx.index] == cnx {
+		s.freeIndex(cnx.index)
+	}
 }
 
 // issueWarning calls a "warn" method on the remote client.
@@ -269,6 +577,41 @@ func (s *Session) SendMethod(name string, params interface{}) {
 	})
 }
 
+// CopyIndexedData copies a message to the client, prefixing it with the index
+// of the connection it came from. Recorded sessions give FrameTooLong for
+// frames longer than the FrameSizeLimit.
+func (s *Session) CopyIndexedData(index int, header ws.Header, r io.Reader) error {
+	if s.recording == nil {
+		s.stats.countReceived(header.Length)
+		return s.Socket.CopyIndexedData(index, header, r)
+	}
+
+	// Recorded sessions read the whole frame, so that it can be recorded.
+	if header.Length > s.config.FrameSizeLimit {
+		Dispose(r)
+		return FrameTooLong
+	}
+	s.stats.countReceived(header.Length)
+	payload := make([]byte, header.Length)
+	_, err := io.ReadFull(r, payload)
+	Dispose(r)
+	if err != nil {
+		return err
+	}
+	s.recording.record(RemoteToClient, index, header, payload)
+	return s.Socket.WriteIndexedData(index, header, payload)
+}
+
+// WriteIndexedData writes a message to the client, prefixing it with the index
+// of the connection it came from.
+func (s *Session) WriteIndexedData(index int, header ws.Header, b []byte) error {
+	s.stats.countReceived(int64(len(b)))
+	if s.recording != nil {
+		s.recording.record(RemoteToClient, index, header, b)
+	}
+	return s.Socket.WriteIndexedData(index, header, b)
+}
+
 // SendControlFrame pushes a method to the socket, prefixing it with the control index.
 func (s *Session) SendControlFrame(v interface{}) {
 	data, err := json.Marshal(v)
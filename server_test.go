@@ -2,8 +2,13 @@ package wsplice
 
 import (
 	"crypto/rand"
+	"net/http"
 	"strings"
+	"testing"
+	"time"
 
+	"github.com/gobwas/ws"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 )
 
@@ -73,3 +78,300 @@ func (e *EndToEndSuite) TestMultiplexes() {
 	e.write(cnx, 1, `{"hello":"world!"}`)
 	e.expectRead(cnx, 1, `{"HELLO":"WORLD!"}`)
 }
+
+func (e *EndToEndSuite) TestListsConnections() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"listConnections"}`)
+	var reply struct {
+		Result ListConnectionsResponse `json:"result"`
+	}
+	e.readJSON(cnx, 0xffff, &reply)
+
+	require.Len(e.T(), reply.Result.Connections, 1)
+	info := reply.Result.Connections[0]
+	require.Equal(e.T(), 0, info.Index)
+	require.Equal(e.T(), url, info.URL)
+	require.Equal(e.T(), int64(18), info.SentBytes)
+	require.Equal(e.T(), int64(1), info.SentMessages)
+	require.Equal(e.T(), int64(18), info.ReceivedBytes)
+	require.Equal(e.T(), int64(1), info.ReceivedMessages)
+	require.Equal(e.T(), StateOpen, info.State)
+	require.False(e.T(), info.OpenedAt.IsZero())
+}
+
+func (e *EndToEndSuite) TestConnectsAsynchronously() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","async":true}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketOpen","params":{"index":0,"subprotocol":""}}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+}
+
+func TestBoundsConnectQueue(t *testing.T) {
+	cnx := &Connection{config: &Config{}, state: int32(StateConnecting)}
+	header := ws.Header{Fin: true, OpCode: ws.OpText, Length: 6}
+
+	// A zero Config uses the default limits.
+	require.Nil(t, cnx.write(header, strings.NewReader("hello!")))
+
+	cnx.config.ConnectQueueBytes = 10
+	require.Equal(t, ConnectQueueFull, cnx.write(header, strings.NewReader("hello!")))
+	require.Len(t, cnx.pending, 1)
+}
+
+func (e *EndToEndSuite) TestReportsAsynchronousDialErrors() {
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"ws://127.0.0.1:1","async":true}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+
+	var closed struct {
+		Method string              `json:"method"`
+		Params SocketClosedCommand `json:"params"`
+	}
+	e.readJSON(cnx, 0xffff, &closed)
+	require.Equal(e.T(), "onSocketClosed", closed.Method)
+	require.Equal(e.T(), 0, closed.Params.Index)
+	require.Equal(e.T(), 1006, closed.Params.Code)
+	require.NotEmpty(e.T(), closed.Params.Reason)
+}
+
+func (e *EndToEndSuite) TestConnectsToRequestedIndex() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","index":5}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":5}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"connect","params":{"url":"`+url+`","index":5}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","error":{"code":4010,"message":`+
+		`"The requested index is in use or was used too recently","path":"index"}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","result":{"index":0}}`)
+
+	e.write(cnx, 5, `{"hello":"world!"}`)
+	e.expectRead(cnx, 5, `{"hello":"world!"}`)
+}
+
+func (e *EndToEndSuite) TestAllocatesMonotonicIndices() {
+	e.config.MonotonicIndices = true
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectReadUnordered(cnx, 0xffff,
+		`{"id":2,"type":"reply","result":{}}`,
+		`{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1001,"reason":"","index":0}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","result":{"index":1}}`)
+}
+
+func (e *EndToEndSuite) TestQuarantinesFreedIndices() {
+	e.config.IndexQuarantine = time.Minute
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectReadUnordered(cnx, 0xffff,
+		`{"id":2,"type":"reply","result":{}}`,
+		`{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1001,"reason":"","index":0}}`)
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","result":{"index":1}}`)
+	e.write(cnx, 0xffff, `{"id":4,"type":"method","method":"connect","params":{"url":"`+url+`","index":0}}`)
+	e.expectRead(cnx, 0xffff, `{"id":4,"type":"reply","error":{"code":4010,"message":`+
+		`"The requested index is in use or was used too recently","path":"index"}}`)
+}
+
+func (e *EndToEndSuite) TestConnectsToDistantRequestedIndex() {
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","index":65534}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":65534}}`)
+	e.write(cnx, 65534, `{"hello":"world!"}`)
+	e.expectRead(cnx, 65534, `{"hello":"world!"}`)
+
+	session := e.server.Sessions()[0]
+	session.connectionsMu.Lock()
+	defer session.connectionsMu.Unlock()
+	require.Len(e.T(), session.connections, 1)
+}
+
+func TestPrunesFreedIndices(t *testing.T) {
+	s := &Session{
+		config:       &Config{IndexQuarantine: time.Millisecond, MonotonicIndices: true},
+		connections:  map[int]*Connection{},
+		freedIndices: map[int]time.Time{},
+	}
+	for i := 0; i < 1000; i++ {
+		index, err := s.insertConnection(&Connection{}, nil)
+		require.Nil(t, err)
+		s.freeIndex(index)
+		if i%100 == 0 {
+			time.Sleep(2 * time.Millisecond)
+		}
+	}
+
+	require.True(t, len(s.freedIndices) < 200, "expected freed indices to be pruned, have %d", len(s.freedIndices))
+}
+
+func (e *EndToEndSuite) TestMeasuresRTTWithPings() {
+	e.config.PingInterval = 10 * time.Millisecond
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	time.Sleep(50 * time.Millisecond)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"listConnections"}`)
+	var reply struct {
+		Result ListConnectionsResponse `json:"result"`
+	}
+	e.readJSON(cnx, 0xffff, &reply)
+	require.Len(e.T(), reply.Result.Connections, 1)
+	require.True(e.T(), reply.Result.Connections[0].RTT > 0, "expected the RTT to have been measured")
+}
+
+func (e *EndToEndSuite) TestClosesUnresponsiveConnections() {
+	e.config.PingInterval = 10 * time.Millisecond
+	e.config.ClientPingInterval = 10 * time.Millisecond
+	e.config.ReadTimeout = 10 * time.Millisecond
+	url := e.makeServer(unresponsive)
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1006,"reason":"read timeout","index":0}}`)
+}
+
+func (e *EndToEndSuite) TestIgnoresReadTimeoutWithoutPings() {
+	e.config.ReadTimeout = 20 * time.Millisecond
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	time.Sleep(100 * time.Millisecond)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+}
+
+func (e *EndToEndSuite) TestClosesIdleConnections() {
+	e.config.MaxIdleTimeout = 20 * time.Millisecond
+	url := e.makeServer(forever(echo))
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","idleTimeout":60000}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1000,"reason":"idle","index":0}}`)
+}
+
+func (e *EndToEndSuite) TestClosesIdleSessions() {
+	e.config.SessionIdleTimeout = 20 * time.Millisecond
+	cnx := e.connectSocket()
+
+	err := e.expectReadError(cnx)
+	closeErr, ok := err.(*websocket.CloseError)
+	require.True(e.T(), ok, "expected a close error, got %v", err)
+	require.Equal(e.T(), 1000, closeErr.Code)
+	require.Equal(e.T(), "idle", closeErr.Text)
+}
+
+func (e *EndToEndSuite) TestWritesAccessLog() {
+	log := &memoryAccessLog{}
+	e.server.AccessLog = log
+	url := e.makeServer(echo)
+	cnx := e.connectSocket()
+
+	e.write(cnx, 0xffff, `{"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1001,"reason":"","index":0}}`)
+
+	records := log.Connections()
+	require.Len(e.T(), records, 1)
+	require.Equal(e.T(), url, records[0].URL)
+	require.Equal(e.T(), 0, records[0].Index)
+	require.Equal(e.T(), int64(18), records[0].SentBytes)
+	require.Equal(e.T(), int64(18), records[0].ReceivedBytes)
+	require.Equal(e.T(), 1001, records[0].CloseCode)
+	require.NotEmpty(e.T(), records[0].SessionID)
+	require.NotEmpty(e.T(), records[0].RemoteAddr)
+}
+
+func (e *EndToEndSuite) TestAppliesNewConfigToNewConnections() {
+	url := e.makeServer(echo)
+	cnx := e.connectSocket()
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+
+	config := *e.config
+	config.HostnameAllowlist = []string{"example.com"}
+	e.server.SetConfig(&config)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	var reply Reply
+	e.readJSON(cnx, 0xffff, &reply)
+	require.NotNil(e.T(), reply.Error)
+	require.Equal(e.T(), DialError, reply.Error.Code)
+
+	// The existing connection is unaffected.
+	e.write(cnx, 0, `{"hello":"world!"}`)
+	e.expectRead(cnx, 0, `{"hello":"world!"}`)
+}
+
+func (e *EndToEndSuite) TestNegotiatesSubprotocols() {
+	dialer := websocket.Dialer{Subprotocols: []string{"other", SubprotocolV1}}
+	cnx, res, err := dialer.Dial("ws:"+e.wspliceServer.URL[5:], http.Header{"X-Secret": {"hunter2"}})
+	require.Nil(e.T(), err)
+	defer cnx.Close()
+
+	require.Equal(e.T(), SubprotocolV1, cnx.Subprotocol())
+	require.Empty(e.T(), res.Header.Get("X-Secret"))
+	require.Empty(e.T(), res.Header.Get("Sec-WebSocket-Key"))
+	require.Equal(e.T(), SubprotocolV1, e.waitForSessions(1)[0].Info().Subprotocol)
+
+	dialer.Subprotocols = []string{"other"}
+	other, _, err := dialer.Dial("ws:"+e.wspliceServer.URL[5:], nil)
+	require.Nil(e.T(), err)
+	defer other.Close()
+	require.Empty(e.T(), other.Subprotocol())
+}
+
+func (e *EndToEndSuite) TestForwardsUpgradeHeaders() {
+	e.config.ForwardableHeaders = []string{"cookie"}
+	url := e.makeHeaderServer("Cookie")
+	cnx, _, err := websocket.DefaultDialer.Dial("ws:"+e.wspliceServer.URL[5:], http.Header{
+		"Cookie":        {"session=secret"},
+		"Authorization": {"Bearer secret"},
+	})
+	require.Nil(e.T(), err)
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","forwardHeaders":["Authorization"]}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","error":{"code":4012,"message":"That header from the upgrade request may not be forwarded","path":"forwardHeaders.0"}}`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"connect","params":{"url":"`+url+`","forwardHeaders":["Cookie"]}}`)
+	e.expectRead(cnx, 0xffff, `{"id":2,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"cookie?"`)
+	e.expectRead(cnx, 0, `"session=secret"`)
+}
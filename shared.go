@@ -0,0 +1,405 @@
+package wsplice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/mixer/go-ext/msync"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// errSharedClosed is the dial error given to connections which subscribe to
+// a shared upstream just as it closes.
+var errSharedClosed = errors.New("the shared connection closed")
+
+// sharedUpstream is a connection to a remote server which is shared by every
+// session that connects to it with "shared": true. Frames it sends are
+// fanned out to all of its subscribers, and it's closed once they've all
+// left.
+type sharedUpstream struct {
+	server *Server
+	key    string
+	// ready is closed once the upstream has been dialed, successfully or
+	// not.
+	ready chan struct{}
+	// cancelDial cancels dialing the upstream. It's dialed with a context
+	// of its own, since it outlives the connection which happens to dial it.
+	cancelDial context.CancelFunc
+
+	// mu guards the fields below. Subscribers map to whether they're open,
+	// and so should get the upstream's frames.
+	mu          sync.Mutex
+	err         error
+	socket      *Socket
+	url         string
+	subprotocol string
+	closed      bool
+	subscribers map[*Connection]bool
+}
+
+// sharedKey returns the key which connections made with the command share an
+// upstream by: connections to the same URL or target, with the same headers
+// and subprotocols.
+func sharedKey(cmd ConnectCommand, headers http.Header) string {
+	key, _ := json.Marshal(struct {
+		URL          string
+		Target       string
+		Path         string
+		Query        map[string]string
+		Headers      http.Header
+		Subprotocols []string
+	}{cmd.URL, cmd.Target, cmd.Path, cmd.Query, headers, cmd.Subprotocols})
+
+	return string(key)
+}
+
+// joinShared subscribes the connection to the shared upstream for the
+// command, dialing it if no other connection has, and waits for it to be
+// dialed. The connection gets no frames until it's opened with openShared.
+func (s *Session) joinShared(ctx context.Context, cnx *Connection, cmd ConnectCommand) error {
+	key := sharedKey(cmd, s.dialHeaders(cmd))
+	srv := s.server
+
+	cnx.mu.Lock()
+	if cnx.State() != StateConnecting {
+		cnx.mu.Unlock()
+		return context.Canceled
+	}
+	srv.sharedMu.Lock()
+	u, dialing := srv.shared[key], false
+	var dialCtx context.Context
+	if u == nil {
+		u = &sharedUpstream{
+			server:      srv,
+			key:         key,
+			ready:       make(chan struct{}),
+			subscribers: map[*Connection]bool{},
+		}
+		dialCtx, u.cancelDial = context.WithCancel(context.Background())
+		if srv.shared == nil {
+			srv.shared = map[string]*sharedUpstream{}
+		}
+		srv.shared[key] = u
+		dialing = true
+	}
+	u.mu.Lock()
+	u.subscribers[cnx] = false
+	u.mu.Unlock()
+	srv.sharedMu.Unlock()
+	cnx.shared = u
+	cnx.mu.Unlock()
+
+	if dialing {
+		// Every subscriber waits on the same dial, so it's bounded by the
+		// dial timeout rather than the one this client asked for.
+		cmd.Timeout = 0
+		conn, resp, err := s.dialConnection(dialCtx, cmd)
+		u.cancelDial()
+		if err != nil {
+			u.finish(nil, "", err)
+		} else {
+			u.finish(NewClientSocket(conn, cnx.config), resp.Protocol, nil)
+		}
+	}
+
+	select {
+	case <-u.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// finish records the result of dialing the upstream and, if it succeeded,
+// starts reading from it. If everyone left while it was being dialed, it's
+// closed straight away.
+func (u *sharedUpstream) finish(socket *Socket, subprotocol string, err error) {
+	if err != nil {
+		u.server.sharedMu.Lock()
+		if u.server.shared[u.key] == u {
+			delete(u.server.shared, u.key)
+		}
+		u.server.sharedMu.Unlock()
+	}
+
+	u.mu.Lock()
+	defer close(u.ready)
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.err = err
+		u.closed = true
+		return
+	}
+
+	u.socket = socket
+	u.subprotocol = subprotocol
+	if conn, ok := socket.Conn.(*backendConn); ok {
+		u.url = conn.url
+	}
+	if u.closed {
+		socket.Close()
+		u.err = errSharedClosed
+		return
+	}
+
+	go u.read()
+}
+
+// read fans out the frames the upstream sends to its open subscribers, until
+// the upstream closes.
+func (u *sharedUpstream) read() {
+	u.socket.StartPinging(u.socket.config.PingInterval)
+
+	for {
+		header, r, err := u.socket.ReadNextWithBody()
+		if isTimeout(err) {
+			u.end(ws.StatusAbnormalClosure, "read timeout")
+			return
+		}
+		if err != nil {
+			u.end(ws.StatusGoingAway, "")
+			return
+		}
+
+		// Every subscriber gets the same payload, so it's read once rather
+		// than copied from the socket, up to the FrameSizeLimit.
+		limit := u.socket.config.FrameSizeLimit
+		payload, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+		Dispose(r)
+		if err != nil {
+			u.end(ws.StatusGoingAway, "")
+			return
+		}
+		if int64(len(payload)) > limit {
+			u.socket.WriteFrame(ws.NewCloseFrame(ws.StatusMessageTooBig, ""))
+			u.end(ws.StatusMessageTooBig, "")
+			return
+		}
+		if header.OpCode == ws.OpClose {
+			u.end(ws.ParseCloseFrameData(payload))
+			return
+		}
+
+		subscribers := u.openSubscribers()
+		msync.Parallel(len(subscribers), defaultParallelism, func(i int) {
+			cnx := subscribers[i]
+			cnx.stats.countReceived(header.Length)
+			cnx.receive(header, bytes.NewReader(payload))
+		})
+	}
+}
+
+// openSubscribers returns the subscribers which have been opened.
+func (u *sharedUpstream) openSubscribers() []*Connection {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	subscribers := make([]*Connection, 0, len(u.subscribers))
+	for cnx, open := range u.subscribers {
+		if open {
+			subscribers = append(subscribers, cnx)
+		}
+	}
+
+	return subscribers
+}
+
+// end closes the upstream after it disconnected, and notifies its open
+// subscribers. Those still joining find that it's closed when they open.
+func (u *sharedUpstream) end(code ws.StatusCode, reason string) {
+	u.server.sharedMu.Lock()
+	if u.server.shared[u.key] == u {
+		delete(u.server.shared, u.key)
+	}
+	u.mu.Lock()
+	u.closed = true
+	u.server.sharedMu.Unlock()
+	subscribers := make([]*Connection, 0, len(u.subscribers))
+	for cnx, open := range u.subscribers {
+		if open {
+			subscribers = append(subscribers, cnx)
+			delete(u.subscribers, cnx)
+		}
+	}
+	u.mu.Unlock()
+
+	u.socket.Close()
+	for _, cnx := range subscribers {
+		cnx.signalClosed(code, reason)
+	}
+}
+
+// leave unsubscribes the connection, closing the upstream, or giving up on
+// dialing it, if it was the last subscriber.
+func (u *sharedUpstream) leave(cnx *Connection) {
+	u.server.sharedMu.Lock()
+	u.mu.Lock()
+	delete(u.subscribers, cnx)
+	last := len(u.subscribers) == 0 && !u.closed
+	if last {
+		u.closed = true
+		if u.server.shared[u.key] == u {
+			delete(u.server.shared, u.key)
+		}
+	}
+	socket := u.socket
+	u.mu.Unlock()
+	u.server.sharedMu.Unlock()
+
+	if last {
+		u.cancelDial()
+	}
+	// If it's still being dialed, finish closes it instead.
+	if last && socket != nil {
+		socket.WriteFrame(ws.NewCloseFrame(ws.StatusNormalClosure, ""))
+		socket.Close()
+	}
+}
+
+// openShared opens a connection which joined a shared upstream, so that it
+// gets the upstream's frames and any frames queued while it was connecting
+// are sent. It returns false if the connection or the upstream was closed in
+// the meantime.
+func (c *Connection) openShared() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u := c.shared
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if c.State() != StateConnecting || u.closed {
+		return false
+	}
+
+	u.subscribers[c] = true
+	c.subprotocol = u.subprotocol
+	if u.url != "" {
+		c.url = u.url
+	}
+	if c.cancelDial != nil {
+		c.cancelDial()
+		c.cancelDial = nil
+	}
+	for _, frame := range c.pending {
+		u.socket.WriteData(frame.header, frame.payload)
+	}
+	c.pending = nil
+	c.pendingSize = 0
+	c.setState(StateOpen)
+	c.span.AddEvent("open", trace.WithAttributes(
+		attribute.String("wsplice.subprotocol", u.subprotocol),
+		attribute.Bool("wsplice.shared", true),
+	))
+
+	return true
+}
+
+// writeShared copies a frame from the client to the shared upstream. Frames
+// from different subscribers are interleaved, so clients should only send
+// whole messages.
+func (c *Connection) writeShared(header ws.Header, frame io.Reader) error {
+	c.shared.mu.Lock()
+	socket := c.shared.socket
+	c.shared.mu.Unlock()
+
+	c.stats.countSent(header.Length, header.Fin)
+	return socket.CopyData(header, frame)
+}
+
+// rtt returns the round trip time to the shared upstream.
+func (u *sharedUpstream) rtt() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.socket.RTT()
+}
+
+// connectShared handles a connect command with "shared": true, subscribing
+// the client to the upstream other sessions share.
+func (s *Session) connectShared(ctx context.Context, cmd ConnectCommand) (interface{}, error) {
+	// Clients joining an upstream someone else dialed must still be allowed
+	// to connect to it.
+	if cmd.upstream == nil {
+		if err := s.checkURL(cmd.URL); err != nil {
+			return nil, &ResponseError{Code: DialError, Message: err.Error(), Path: "url"}
+		}
+	}
+	if cmd.Async {
+		return s.connectSharedAsync(ctx, cmd)
+	}
+	if cmd.Index != nil && !s.IndexAvailable(*cmd.Index) {
+		return nil, IndexInUse.WithPath("index")
+	}
+
+	cnx := newConnection(ctx, s, cmd)
+	if err := s.joinShared(ctx, cnx, cmd); err != nil {
+		cnx.close()
+		endSpan(cnx.span, err)
+		return nil, &ResponseError{Code: DialError, Message: dialErrorMessage(cmd, err), Path: "url"}
+	}
+
+	index, err := s.insertConnection(cnx, cmd.Index)
+	if err != nil {
+		cnx.close()
+		endSpan(cnx.span, err)
+		return nil, err
+	}
+	if !cnx.openShared() {
+		s.removeConnection(cnx)
+		endSpan(cnx.span, errSharedClosed)
+		return nil, &ResponseError{Code: DialError, Message: dialErrorMessage(cmd, errSharedClosed), Path: "url"}
+	}
+	cnx.startIdleTimer()
+
+	return ConnectResponse{index}, nil
+}
+
+// connectSharedAsync is like connectAsync, but joins a shared upstream
+// rather than dialing one of its own.
+func (s *Session) connectSharedAsync(ctx context.Context, cmd ConnectCommand) (interface{}, error) {
+	cnx := newConnection(ctx, s, cmd)
+	ctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), cnx.span))
+	cnx.cancelDial = cancel
+	index, err := s.insertConnection(cnx, cmd.Index)
+	if err != nil {
+		cancel()
+		endSpan(cnx.span, err)
+		return nil, err
+	}
+
+	return afterReply{ConnectResponse{index}, func() { go s.joinSharedAsync(ctx, cnx, cmd) }}, nil
+}
+
+// joinSharedAsync joins the shared upstream for a connection created by
+// connectSharedAsync, notifying the client whether it succeeded.
+func (s *Session) joinSharedAsync(ctx context.Context, cnx *Connection, cmd ConnectCommand) {
+	err := s.joinShared(ctx, cnx, cmd)
+	if err == nil && !cnx.openShared() {
+		err = errSharedClosed
+	}
+	if err != nil {
+		if cnx.State() == StateConnecting {
+			cnx.signalClosed(ws.StatusAbnormalClosure, dialErrorMessage(cmd, err))
+		} else {
+			cnx.span.End()
+		}
+		return
+	}
+
+	s.SendMethod("onSocketOpen", SocketOpenCommand{Index: cnx.index, Subprotocol: cnx.Info().Subprotocol})
+	cnx.startIdleTimer()
+}
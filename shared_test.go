@@ -0,0 +1,188 @@
+package wsplice
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// makeFeedServer starts a remote server which sends every message published
+// on the channel to whoever is connected. It counts how many times it's
+// dialed, and signals on closed when a connection to it closes.
+func (e *EndToEndSuite) makeFeedServer(publish <-chan string, closed chan<- struct{}) (address string, dials *int32) {
+	dials = new(int32)
+	address = e.makeUpgradeServer(func(c *websocket.Conn, r *http.Request) {
+		atomic.AddInt32(dials, 1)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				if _, _, err := c.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case message := <-publish:
+				c.WriteMessage(websocket.TextMessage, []byte(message))
+			case <-done:
+				closed <- struct{}{}
+				return
+			}
+		}
+	})
+
+	return address, dials
+}
+
+func (e *EndToEndSuite) TestSharesUpstreams() {
+	publish, closed := make(chan string), make(chan struct{}, 2)
+	url, dials := e.makeFeedServer(publish, closed)
+
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	e.write(a, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","shared":true}}`)
+	e.expectRead(a, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(b, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","index":3,"shared":true}}`)
+	e.expectRead(b, 0xffff, `{"id":1,"type":"reply","result":{"index":3}}`)
+	require.Equal(e.T(), int32(1), atomic.LoadInt32(dials))
+
+	publish <- `"hello"`
+	e.expectRead(a, 0, `"hello"`)
+	e.expectRead(b, 3, `"hello"`)
+
+	e.write(a, 0, `"hi"`)
+	e.expectRead(a, 0xffff, `{"id":0,"type":"method","method":"warn","params":{"code":4015,`+
+		`"message":"You may not send messages to a shared connection"}}`)
+
+	// The upstream stays open until its last subscriber leaves.
+	e.write(a, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectRead(a, 0xffff, `{"id":2,"type":"reply","result":{}}`)
+	publish <- `"still here"`
+	e.expectRead(b, 3, `"still here"`)
+
+	e.write(b, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":3}}`)
+	e.expectRead(b, 0xffff, `{"id":2,"type":"reply","result":{}}`)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		require.Fail(e.T(), "expected the shared upstream to be closed")
+	}
+
+	e.write(a, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"url":"`+url+`","shared":true}}`)
+	e.expectRead(a, 0xffff, `{"id":3,"type":"reply","result":{"index":0}}`)
+	require.Equal(e.T(), int32(2), atomic.LoadInt32(dials))
+}
+
+func (e *EndToEndSuite) TestAllowsSharedWrites() {
+	e.config.SharedWrites = true
+	url := e.makeServer(forever(echo))
+
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","shared":true}}`)
+		e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	}
+
+	e.write(a, 0, `"hi"`)
+	e.expectRead(a, 0, `"hi"`)
+	e.expectRead(b, 0, `"hi"`)
+}
+
+func (e *EndToEndSuite) TestClosesSharedSubscribers() {
+	stop := make(chan struct{})
+	url := e.makeServer(func(c *websocket.Conn) error {
+		<-stop
+		return nil
+	})
+
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","async":true,"shared":true}}`)
+		e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+		e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketOpen","params":{"index":0,"subprotocol":""}}`)
+	}
+
+	close(stop)
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1001,"reason":"","index":0}}`)
+	}
+}
+
+func (e *EndToEndSuite) TestClosesSharedUpstreamsSendingTooLargeFrames() {
+	publish, closed := make(chan string), make(chan struct{}, 1)
+	url, _ := e.makeFeedServer(publish, closed)
+
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","async":true,"shared":true}}`)
+		e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+		e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketOpen","params":{"index":0,"subprotocol":""}}`)
+	}
+
+	publish <- strings.Repeat("a", 600*1024)
+	for _, cnx := range []*websocket.Conn{a, b} {
+		e.expectRead(cnx, 0xffff, `{"id":0,"type":"method","method":"onSocketClosed","params":{"code":1009,"reason":"","index":0}}`)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		e.T().Fatal("expected the upstream to be closed")
+	}
+}
+
+func (e *EndToEndSuite) TestDialsSharedUpstreamsForEveryone() {
+	dialed, release := make(chan struct{}), make(chan struct{})
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(dialed)
+		<-release
+		if c, err := upgrader.Upgrade(w, r, nil); err == nil {
+			defer c.Close()
+			c.ReadMessage()
+		}
+	}))
+	e.servers = append(e.servers, s)
+	url := "ws:" + s.URL[5:]
+
+	a, b := e.connectSocket(), e.connectSocket()
+	defer a.Close()
+	defer b.Close()
+	e.write(a, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","async":true,"shared":true}}`)
+	e.expectRead(a, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	<-dialed
+	e.write(b, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`","async":true,"shared":true}}`)
+	e.expectRead(b, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	require.Eventually(e.T(), func() bool {
+		e.server.sharedMu.Lock()
+		defer e.server.sharedMu.Unlock()
+		for _, u := range e.server.shared {
+			u.mu.Lock()
+			defer u.mu.Unlock()
+			return len(u.subscribers) == 2
+		}
+		return false
+	}, time.Second, 5*time.Millisecond)
+
+	// The client which started dialing leaving doesn't stop the dial for
+	// the others.
+	e.write(a, 0xffff, `{"id":2,"type":"method","method":"terminate","params":{"index":0}}`)
+	e.expectRead(a, 0xffff, `{"id":2,"type":"reply","result":{}}`)
+	close(release)
+	e.expectRead(b, 0xffff, `{"id":0,"type":"method","method":"onSocketOpen","params":{"index":0,"subprotocol":""}}`)
+}
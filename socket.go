@@ -7,60 +7,170 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 )
 
-// Socket is a wrapper that provides useful utilities around a websocket net.Conn.
+// Socket is a wrapper that provides useful utilities around a websocket
+// net.Conn, or another Transport.
 type Socket struct {
+	rtt int64 // nanoseconds, accessed atomically
+
+	// Conn is the connection the socket's frames are carried on, or nil if
+	// they're carried on another Transport, like an event stream.
 	Conn        net.Conn
 	Reader      *bufio.Reader
 	config      *Config
-	buffer      []byte
 	bytesBuffer bytes.Buffer
+
+	// mask is true if this is the client side of the websocket, in which
+	// case frames we create must be masked.
+	mask bool
+	// transport reads and writes the socket's frames.
+	transport Transport
+
+	pingInterval time.Duration
+	writeMu      sync.Mutex
+	closed       chan struct{}
+	closeOnce    sync.Once
 }
 
 // NewSocket creates a new websocket.
 func NewSocket(conn net.Conn, config *Config) *Socket {
-	s := &Socket{
-		Conn:   conn,
-		config: config,
-		Reader: bufio.NewReader(conn),
-		buffer: make([]byte, copyBufferSize),
+	return newSocket(newConnTransport(conn, websocketFraming{}), config)
+}
+
+// newSocket creates a socket whose frames are carried on the transport.
+func newSocket(transport Transport, config *Config) *Socket {
+	s := &Socket{}
+	s.init(transport, config)
+	return s
+}
+
+// init sets up a zero Socket in place, for sockets embedded in other
+// structs, to carry frames on the transport.
+func (s *Socket) init(transport Transport, config *Config) {
+	s.config = config
+	s.Reader = bufio.NewReader(transport)
+	s.transport = transport
+	s.closed = make(chan struct{})
+	if t, ok := transport.(*connTransport); ok {
+		s.Conn = t.Conn
 	}
+}
 
+// NewClientSocket creates a new websocket for a connection that wsplice
+// dialed, where wsplice acts as the websocket client.
+func NewClientSocket(conn net.Conn, config *Config) *Socket {
+	s := NewSocket(conn, config)
+	s.mask = true
 	return s
 }
 
+// StartPinging sends a ping on the socket every interval until it's closed.
+// Once pinging, reads time out if nothing is heard from the remote within
+// the interval plus the configured ReadTimeout, rather than the ReadTimeout
+// alone. It must be called before the socket is read from.
+func (s *Socket) StartPinging(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	s.pingInterval = interval
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				var payload [8]byte
+				binary.BigEndian.PutUint64(payload[:], uint64(time.Now().UnixNano()))
+				s.WriteFrame(ws.NewPingFrame(payload[:]))
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+}
+
+// RTT returns the round trip time last measured by a ping, or zero if none
+// has been measured.
+func (s *Socket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// readDeadline returns the deadline for reading the next frame, or zero if
+// the socket isn't pinged, in which case reads don't time out.
+func (s *Socket) readDeadline() time.Time {
+	if s.pingInterval <= 0 {
+		return time.Time{}
+	}
+
+	timeout := s.config.ReadTimeout
+	if timeout == 0 {
+		timeout = s.pingInterval
+	}
+	return time.Now().Add(s.pingInterval + timeout)
+}
+
 // ReadNextFrame reads the next non-control or close frame off of the socket.
 // Ping/pong frames are handled automatically.
 func (s *Socket) ReadNextFrame() (header ws.Header, err error) {
 	for {
-		s.Conn.SetReadDeadline(time.Time{})
-		if header, err = ws.ReadHeader(s.Reader); err != nil {
+		s.transport.SetReadDeadline(s.readDeadline())
+		if header, err = s.transport.ReadHeader(); err != nil {
 			return
 		}
 
 		switch header.OpCode {
 		case ws.OpPing:
-			s.Conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-			s.WriteFrame(ws.NewPongFrame(nil))
+			payload, err := s.readControlPayload(header)
+			if err != nil {
+				return header, err
+			}
+			s.WriteFrame(ws.NewPongFrame(payload))
 		case ws.OpPong:
-			// ignored
+			payload, err := s.readControlPayload(header)
+			if err != nil {
+				return header, err
+			}
+			if len(payload) == 8 {
+				sent := int64(binary.BigEndian.Uint64(payload))
+				atomic.StoreInt64(&s.rtt, time.Now().UnixNano()-sent)
+			}
 		default:
 			return
 		}
 	}
 }
 
+// readControlPayload reads and unmasks the payload of a ping or pong frame.
+func (s *Socket) readControlPayload(header ws.Header) ([]byte, error) {
+	if header.Length > ws.MaxControlFramePayloadSize {
+		return nil, ws.ErrProtocolControlPayloadOverflow
+	}
+
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(s.Reader, payload); err != nil {
+		return nil, err
+	}
+	if header.Masked {
+		ws.Cipher(payload, header.Mask, 0)
+	}
+
+	return payload, nil
+}
+
 // ReadNextWithBody returns the next non-control or close frame off the socket,
 // joining fragmented messages bodies. This should only be used if you actually
 // need to join fragmented messages, as it buffers data internally in memory.
 func (s *Socket) ReadNextWithBody() (header ws.Header, r io.Reader, err error) {
 	header, err = s.ReadNextFrame()
 	if err != nil || header.OpCode == ws.OpClose {
-		return header, io.LimitReader(s.Conn, header.Length), err
+		return header, io.LimitReader(s.Reader, header.Length), err
 	}
 
 	if header.Fin {
@@ -83,68 +193,85 @@ func (s *Socket) WriteData(header ws.Header, b []byte) error {
 
 // CopyIndexedData copies data from the CountingReader to the socket, prefixing
 // it with the index for the incoming socket.
-func (s *Socket) CopyIndexedData(index int, header ws.Header, r io.Reader) (err error) {
-	if index != -1 {
-		header.Length += indexBytesSize
-	}
-
-	// We have a bytes buffer here that we use for constructing the index and
-	// header. For small packets, we can for the buffer in memory entirely
-	// instead of using io.Copy to save syscalls and network writes.
-	rbuf := bytes.NewBuffer(s.buffer[:0])
-	s.Conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	ws.WriteHeader(rbuf, header)
-
-	if index != -1 {
-		var indexBytes [indexBytesSize]byte
-		binary.BigEndian.PutUint16(indexBytes[:], uint16(index))
-		rbuf.Write(indexBytes[:])
+func (s *Socket) CopyIndexedData(index int, header ws.Header, r io.Reader) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	defer Dispose(r)
+
+	// Frames from clients which don't mask them, like raw clients, are
+	// masked on their way to remote servers.
+	payload := r
+	if s.mask && !header.Masked {
+		header.Masked, header.Mask = true, newMask()
+		payload = NewMasked(&io.LimitedReader{R: r, N: header.Length}, 0, header.Mask)
 	}
 
-	if header.Length < int64(rbuf.Cap()-rbuf.Len()) {
-		rbuf.ReadFrom(r)
-		_, err = rbuf.WriteTo(s.Conn)
-	} else {
-		rbuf.WriteTo(s.Conn)
-		_, err = io.CopyBuffer(s.Conn, r, s.buffer)
-	}
-
-	Dispose(r)
-
-	return err
+	return s.writeFrame(index, header, payload)
 }
 
 // CopyIndexedData writes data from the byte slice to the socket, prefixing
 // it with the index for the incoming socket.
-func (s *Socket) WriteIndexedData(index int, header ws.Header, b []byte) (err error) {
+func (s *Socket) WriteIndexedData(index int, header ws.Header, b []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.mask && !header.Masked {
+		header.Masked, header.Mask = true, newMask()
+		b = append([]byte(nil), b...)
+		ws.Cipher(b, header.Mask, 0)
+	}
 	header.Length = int64(len(b))
-	if index != -1 {
-		header.Length += indexBytesSize
+
+	return s.writeFrame(index, header, bytes.NewReader(b))
+}
+
+// WriteFrame writes a frame to the websocket, masking it if necessary.
+func (s *Socket) WriteFrame(frame ws.Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if s.mask && !frame.Header.Masked {
+		frame = ws.MaskFrame(frame)
 	}
 
-	s.Conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	ws.WriteHeader(s.Conn, header)
+	return s.writeFrame(-1, frame.Header, bytes.NewReader(frame.Payload))
+}
 
+// writeFrame writes a frame to the transport, prefixing its payload with the
+// index unless it's -1. The writeMu must be held.
+func (s *Socket) writeFrame(index int, header ws.Header, payload io.Reader) error {
 	if index != -1 {
 		var indexBytes [indexBytesSize]byte
 		binary.BigEndian.PutUint16(indexBytes[:], uint16(index))
-		s.Conn.Write(indexBytes[:])
+		header.Length += indexBytesSize
+		payload = io.MultiReader(bytes.NewReader(indexBytes[:]), payload)
 	}
 
-	_, err = s.Conn.Write(b)
+	s.transport.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+	return s.transport.WriteFrame(header, payload)
+}
 
-	return err
+// Close closes the underlying connection.
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.transport.Close()
 }
 
-// WriteFrame writes a frame to the websocket.
-func (s *Socket) WriteFrame(frame ws.Frame) error {
-	s.Conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
-	return ws.WriteFrame(s.Conn, frame)
+// framing reads and writes the headers which delimit frames on a
+// connection, so that sessions can run over protocols other than
+// websockets.
+type framing interface {
+	readHeader(r io.Reader) (ws.Header, error)
+	writeHeader(w io.Writer, header ws.Header) error
 }
 
-// Close closes the underlying connection.
-func (s *Socket) Close() error {
-	return s.Conn.Close()
+// websocketFraming delimits frames with websocket frame headers.
+type websocketFraming struct{}
+
+func (websocketFraming) readHeader(r io.Reader) (ws.Header, error) { return ws.ReadHeader(r) }
+
+func (websocketFraming) writeHeader(w io.Writer, header ws.Header) error {
+	return ws.WriteHeader(w, header)
 }
 
 var fragmentBufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
@@ -0,0 +1,57 @@
+package wsplice
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// trafficStats holds counters for data flowing through a connection. All
+// fields are accessed atomically; they're kept at the start of the struct so
+// that they're 64-bit aligned on 32-bit platforms.
+type trafficStats struct {
+	sentBytes        int64
+	sentMessages     int64
+	receivedBytes    int64
+	receivedMessages int64
+	lastActivity     int64 // unix nanoseconds
+}
+
+// countSent records n bytes sent towards the remote server. If fin is true,
+// the frame was the last one in a message.
+func (t *trafficStats) countSent(n int64, fin bool) {
+	atomic.AddInt64(&t.sentBytes, n)
+	if fin {
+		atomic.AddInt64(&t.sentMessages, 1)
+	}
+	t.touch()
+}
+
+// countReceived records a message of n bytes read from the remote server.
+func (t *trafficStats) countReceived(n int64) {
+	atomic.AddInt64(&t.receivedBytes, n)
+	atomic.AddInt64(&t.receivedMessages, 1)
+	t.touch()
+}
+
+// touch updates the last activity time to now.
+func (t *trafficStats) touch() {
+	atomic.StoreInt64(&t.lastActivity, time.Now().UnixNano())
+}
+
+// LastActivity returns the last time that data was sent or received.
+func (t *trafficStats) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&t.lastActivity))
+}
+
+// durationMillis converts the duration to fractional milliseconds, as used
+// in the protocol.
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// isTimeout returns whether the error is a network timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
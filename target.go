@@ -37,11 +37,12 @@ func NewRPCTarget(copyBuffer []byte, s *Session) *RPCTarget {
 		if err != nil {
 			return
 		}
-		data, err := r.s.rpc.Dispatch(method)
+		data, err := r.s.rpc.Dispatch(s.ctx, method)
 		if err != nil {
 			s.handleError(err)
 		} else {
 			s.SendControlFrame(data)
+			runAfterReply(data)
 		}
 	}()
 
@@ -85,8 +86,13 @@ type ConnectionTarget struct{ c *Connection }
 
 // Pull implements Target.Pull. It copies the frame to the target connection.
 func (c *ConnectionTarget) Pull(header ws.Header, _ *Socket, frame *io.LimitedReader) (err error) {
-	c.c.socket.CopyData(header, frame)
-	return
+	// Errors writing to the remote server will surface when its connection
+	// is read from, we only need to report protocol errors to the client.
+	if err := c.c.Write(header, frame); isErrorCode(err) {
+		return err
+	}
+
+	return nil
 }
 
 // Close implements Target.Close.
@@ -0,0 +1,102 @@
+package wsplice
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name wsplice's spans are created with.
+const tracerName = "github.com/mixer/wsplice"
+
+// tracer returns the Tracer that the server's sessions should use.
+func (s *Server) tracer() trace.Tracer {
+	if s.TracerProvider != nil {
+		return s.TracerProvider.Tracer(tracerName)
+	}
+
+	return otel.GetTracerProvider().Tracer(tracerName)
+}
+
+// propagator returns the propagator used to read trace context from clients
+// and pass it on to remote servers.
+func (s *Server) propagator() propagation.TextMapPropagator {
+	if s.Propagator != nil {
+		return s.Propagator
+	}
+
+	return propagation.TraceContext{}
+}
+
+// tracedURL returns the URL without its query string or user info, which
+// often hold credentials we don't want in traces.
+func tracedURL(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String()
+}
+
+// endSpan sets the span's status from the error, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// closeAttributes describes how a session or connection was closed.
+func closeAttributes(code ws.StatusCode, reason string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("wsplice.close_code", int(code)),
+		attribute.String("wsplice.close_reason", reason),
+	}
+}
+
+// statsAttributes describes the traffic through a session or connection.
+func statsAttributes(sentBytes, sentMessages, receivedBytes, receivedMessages int64) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int64("wsplice.sent_bytes", sentBytes),
+		attribute.Int64("wsplice.sent_messages", sentMessages),
+		attribute.Int64("wsplice.received_bytes", receivedBytes),
+		attribute.Int64("wsplice.received_messages", receivedMessages),
+	}
+}
+
+// startSessionSpan starts the span which covers the whole session.
+func (s *Session) startSessionSpan(ctx context.Context) {
+	s.ctx, s.span = s.tracer.Start(ctx, "wsplice.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("wsplice.session_id", s.id),
+			attribute.String("client.address", s.remoteAddr),
+			attribute.String("wsplice.identity", s.identity),
+		),
+	)
+}
+
+// endSessionSpan records how the session ended and ends its span.
+func (s *Session) endSessionSpan() {
+	s.span.SetAttributes(closeAttributes(s.closeCode, s.closeReason)...)
+	s.span.SetAttributes(statsAttributes(
+		atomic.LoadInt64(&s.stats.sentBytes),
+		atomic.LoadInt64(&s.stats.sentMessages),
+		atomic.LoadInt64(&s.stats.receivedBytes),
+		atomic.LoadInt64(&s.stats.receivedMessages),
+	)...)
+	s.span.End()
+}
@@ -0,0 +1,97 @@
+package wsplice
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// A Transport carries a session's frames between wsplice and its client.
+// Websocket connections are one, and Server.ServeTransport runs sessions
+// over others, like the event streams which carry frames to clients as
+// Server-Sent Events and from them as POST requests.
+type Transport interface {
+	// ReadHeader waits for the next frame from the client and returns its
+	// header. The frame's payload is then read with Read, which returns
+	// io.EOF at its end.
+	ReadHeader() (ws.Header, error)
+	io.Reader
+	// WriteFrame sends a frame to the client, reading its payload from r.
+	WriteFrame(header ws.Header, r io.Reader) error
+
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	RemoteAddr() net.Addr
+	Close() error
+}
+
+// connTransport carries frames on a connection, delimited by the framing.
+type connTransport struct {
+	net.Conn
+	reader  *bufio.Reader
+	framing framing
+	buffer  []byte
+
+	// remaining is the length of the current frame's payload that's yet to
+	// be read.
+	remaining int64
+}
+
+func newConnTransport(conn net.Conn, framing framing) *connTransport {
+	return &connTransport{
+		Conn:    conn,
+		reader:  bufio.NewReader(conn),
+		framing: framing,
+		buffer:  make([]byte, copyBufferSize),
+	}
+}
+
+func (t *connTransport) ReadHeader() (ws.Header, error) {
+	if t.remaining > 0 {
+		if _, err := t.reader.Discard(int(t.remaining)); err != nil {
+			return ws.Header{}, err
+		}
+	}
+
+	header, err := t.framing.readHeader(t.reader)
+	t.remaining = header.Length
+	return header, err
+}
+
+func (t *connTransport) Read(p []byte) (int, error) {
+	if t.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > t.remaining {
+		p = p[:t.remaining]
+	}
+
+	n, err := t.reader.Read(p)
+	t.remaining -= int64(n)
+	return n, err
+}
+
+func (t *connTransport) WriteFrame(header ws.Header, r io.Reader) (err error) {
+	// For small frames, we build the whole frame in the buffer instead of
+	// using io.Copy, to save syscalls and network writes.
+	rbuf := bytes.NewBuffer(t.buffer[:0])
+	if err := t.framing.writeHeader(rbuf, header); err != nil {
+		return err
+	}
+
+	if header.Length < int64(rbuf.Cap()-rbuf.Len()) {
+		rbuf.ReadFrom(r)
+		_, err = rbuf.WriteTo(t.Conn)
+		return err
+	}
+
+	if _, err = rbuf.WriteTo(t.Conn); err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(t.Conn, r, t.buffer)
+	return err
+}
@@ -0,0 +1,142 @@
+package wsplice
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// An Upstream is a remote server which operators configure by name, so that
+// clients can connect to it without knowing its address or credentials.
+type Upstream struct {
+	// URL is the websocket URL of the server. Paths clients give are added
+	// to the end of its path, and their query parameters to its own.
+	URL string
+	// Headers are sent to the server, taking precedence over any headers
+	// the client gives.
+	Headers map[string]string
+	// TLSConfig, if set, is used to dial "wss" URLs.
+	TLSConfig *tls.Config
+	// DialTimeout, if set, is the longest clients may wait to connect to the
+	// upstream, instead of the Config's DialTimeout.
+	DialTimeout time.Duration
+
+	// Backends, if given, are the URLs of a pool of servers which serve the
+	// upstream, and are used instead of its URL. Each connection is dialed
+	// to one of them, chosen by the Balancer. If the dial fails, the others
+	// are tried in turn until the dial timeout runs out.
+	Backends []string
+	Balancer Balancer
+	// Backends which fail MaxFailures dials in a row are ejected from the
+	// pool for the EjectionTime; they're only dialed while there are no
+	// others. These default to 3 and 30 seconds.
+	MaxFailures  int
+	EjectionTime time.Duration
+	// HealthCheckInterval, if set, is how often each backend is dialed to
+	// check its health. Backends which fail are treated like ejected ones
+	// until they pass.
+	HealthCheckInterval time.Duration
+
+	// Schema, if set, validates the messages clients send to the upstream,
+	// which must be JSON. Messages which don't match it aren't forwarded, and the
+	// client gets a "warn" with InvalidPayload instead. Connections to
+	// upstreams without a Schema copy frames straight through.
+	Schema *jsonschema.Schema
+
+	poolOnce sync.Once
+	pool     *pool
+}
+
+// header returns the upstream's Headers as an http.Header.
+func (u *Upstream) header() http.Header {
+	header := http.Header{}
+	for key, value := range u.Headers {
+		header.Set(key, value)
+	}
+
+	return header
+}
+
+// resolveTarget points the command at the URL of its target upstream, if it
+// names one. Clients may only give raw URLs if the config allows them.
+func (s *Session) resolveTarget(cmd *ConnectCommand) error {
+	config := s.dialConfig()
+	if cmd.Target == "" {
+		if config.ForbidRawURLs {
+			return RawURLForbidden.WithPath("url")
+		}
+		return nil
+	}
+	if cmd.URL != "" {
+		return InvalidURL.WithPath("url")
+	}
+
+	upstream := config.Upstreams[cmd.Target]
+	if upstream == nil {
+		return UnknownTarget.WithPath("target")
+	}
+
+	// Pooled upstreams' URLs depend on which backend is dialed.
+	if len(upstream.Backends) == 0 {
+		target, err := targetURL(upstream.URL, *cmd)
+		if err != nil {
+			return err
+		}
+		cmd.URL = target
+	}
+
+	headers := map[string]string{}
+	for key, value := range cmd.Headers {
+		headers[key] = value
+	}
+	for key, value := range upstream.Headers {
+		headers[key] = value
+	}
+
+	cmd.Headers = headers
+	cmd.upstream = upstream
+	return nil
+}
+
+// targetURL adds the path and query the client gave to the URL of an
+// upstream or one of its backends.
+func targetURL(base string, cmd ConnectCommand) (string, error) {
+	target, err := url.Parse(base)
+	if err != nil {
+		return "", InvalidURL.WithPath("target")
+	}
+
+	// Clean the client's path on its own first so that it can't climb out
+	// of the upstream's path with "..".
+	if cmd.Path != "" {
+		target.Path = path.Join(target.Path, path.Clean("/"+cmd.Path))
+	}
+	if len(cmd.Query) > 0 {
+		query := url.Values{}
+		for key, value := range cmd.Query {
+			query.Set(key, value)
+		}
+		for key, values := range target.Query() {
+			query[key] = values
+		}
+		target.RawQuery = query.Encode()
+	}
+
+	return target.String(), nil
+}
+
+// dialErrorMessage returns the message to give the client when dialing
+// fails. Errors dialing upstreams are hidden, since they can reveal the
+// upstream's address.
+func dialErrorMessage(cmd ConnectCommand, err error) string {
+	if cmd.upstream != nil {
+		return "Error connecting to target " + cmd.Target
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,82 @@
+package wsplice
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// makeRequestServer starts a remote server which replies to a message with
+// the path and query it was dialed with, and its X-Token header.
+func (e *EndToEndSuite) makeRequestServer() (address string) {
+	return e.makeUpgradeServer(func(c *websocket.Conn, r *http.Request) {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+			c.WriteMessage(websocket.TextMessage, []byte(`"`+r.URL.RequestURI()+` `+r.Header.Get("X-Token")+`"`))
+		}
+	})
+}
+
+func (e *EndToEndSuite) TestConnectsToTargets() {
+	e.config.HostnameAllowlist = []string{"example.com"}
+	e.config.Upstreams = map[string]*Upstream{
+		"chat": {URL: e.makeRequestServer() + "/ws?key=secret", Headers: map[string]string{"X-Token": "secret"}},
+	}
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"target":"chat","path":"/../room/5",`+
+		`"query":{"key":"mine","page":"2"},"headers":{"X-Token":"mine"}}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"request?"`)
+	e.expectRead(cnx, 0, `"/ws/room/5?key=secret&page=2 secret"`)
+
+	e.write(cnx, 0xffff, `{"id":2,"type":"method","method":"listConnections"}`)
+	var reply struct {
+		Result ListConnectionsResponse `json:"result"`
+	}
+	e.readJSON(cnx, 0xffff, &reply)
+	require.Len(e.T(), reply.Result.Connections, 1)
+	require.Equal(e.T(), "chat", reply.Result.Connections[0].Target)
+	require.Empty(e.T(), reply.Result.Connections[0].URL)
+
+	e.write(cnx, 0xffff, `{"id":3,"type":"method","method":"connect","params":{"target":"nope"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":3,"type":"reply","error":{"code":4013,"message":"There is no target with that name","path":"target"}}`)
+}
+
+func (e *EndToEndSuite) TestHidesTargetDialErrors() {
+	e.config.Upstreams = map[string]*Upstream{"dead": {URL: "ws://127.0.0.1:1"}}
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"target":"dead"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","error":{"code":4007,"message":"Error connecting to target dead","path":"url"}}`)
+}
+
+func (e *EndToEndSuite) TestForbidsRawURLs() {
+	e.config.ForbidRawURLs = true
+	url := e.makeServer(echo)
+	cnx := e.connectSocket()
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"url":"`+url+`"}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","error":{"code":4014,"message":"You must connect to a named target rather than a URL","path":"url"}}`)
+}
+
+func (e *EndToEndSuite) TestPrefersTargetHeadersToForwardedOnes() {
+	e.config.ForwardableHeaders = []string{"X-Token"}
+	e.config.Upstreams = map[string]*Upstream{
+		"chat": {URL: e.makeRequestServer(), Headers: map[string]string{"X-Token": "secret"}},
+	}
+	cnx, _, err := websocket.DefaultDialer.Dial("ws:"+e.wspliceServer.URL[5:], http.Header{"X-Token": {"mine"}})
+	require.Nil(e.T(), err)
+	defer cnx.Close()
+
+	e.write(cnx, 0xffff, `{"id":1,"type":"method","method":"connect","params":{"target":"chat","forwardHeaders":["X-Token"]}}`)
+	e.expectRead(cnx, 0xffff, `{"id":1,"type":"reply","result":{"index":0}}`)
+	e.write(cnx, 0, `"request?"`)
+	e.expectRead(cnx, 0, `"/ secret"`)
+}
@@ -2,12 +2,16 @@ package wsplice
 
 import (
 	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 	"time"
 
 	"strings"
+	"sync"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
@@ -18,6 +22,8 @@ var upgrader websocket.Upgrader
 
 type EndToEndSuite struct {
 	suite.Suite
+	config        *Config
+	server        *Server
 	wspliceServer *httptest.Server
 	servers       []*httptest.Server
 }
@@ -27,15 +33,15 @@ func TestEndToEndSuite(t *testing.T) {
 }
 
 func (e *EndToEndSuite) SetupTest() {
-	e.wspliceServer = httptest.NewServer(&Server{
-		Config: &Config{
-			FrameSizeLimit:    1024 * 512,
-			ReadTimeout:       time.Second,
-			WriteTimeout:      time.Second,
-			DialTimeout:       time.Second,
-			HostnameAllowlist: []string{"127.0.0.1"},
-		},
-	})
+	e.config = &Config{
+		FrameSizeLimit:    1024 * 512,
+		ReadTimeout:       time.Second,
+		WriteTimeout:      time.Second,
+		DialTimeout:       time.Second,
+		HostnameAllowlist: []string{"127.0.0.1"},
+	}
+	e.server = &Server{Config: e.config}
+	e.wspliceServer = httptest.NewServer(e.server)
 }
 
 func (e *EndToEndSuite) TearDownTest() {
@@ -67,6 +73,45 @@ func (e *EndToEndSuite) expectRead(cnx *websocket.Conn, index int, expected stri
 	}
 }
 
+// expectReadUnordered reads len(expected) JSON messages from the index,
+// which may arrive in any order.
+func (e *EndToEndSuite) expectReadUnordered(cnx *websocket.Conn, index int, expected ...string) {
+	var actual []string
+	for range expected {
+		var message json.RawMessage
+		e.readJSON(cnx, index, &message)
+		actual = append(actual, string(message))
+	}
+
+	for _, exp := range expected {
+		var matched bool
+		for i, act := range actual {
+			if jsonEqual(exp, act) {
+				actual = append(actual[:i], actual[i+1:]...)
+				matched = true
+				break
+			}
+		}
+		require.True(e.T(), matched, "Expected to read %s, got %v", exp, actual)
+	}
+}
+
+func jsonEqual(a, b string) bool {
+	var av, bv interface{}
+	return json.Unmarshal([]byte(a), &av) == nil &&
+		json.Unmarshal([]byte(b), &bv) == nil &&
+		reflect.DeepEqual(av, bv)
+}
+
+func (e *EndToEndSuite) readJSON(cnx *websocket.Conn, index int, v interface{}) {
+	prefix := getIndexPrefix(index)
+	_, b, err := cnx.ReadMessage()
+
+	e.expectNoerr(err)
+	require.Equal(e.T(), prefix, b[:len(prefix)], "Got invalid prefix in message: %s", string(b))
+	e.expectNoerr(json.Unmarshal(b[len(prefix):], v))
+}
+
 func (e *EndToEndSuite) expectReadError(cnx *websocket.Conn) error {
 	_, _, err := cnx.ReadMessage()
 	require.NotNil(e.T(), err, "expected to read an error")
@@ -107,6 +152,60 @@ func (e *EndToEndSuite) makeServer(handler func(conn *websocket.Conn) error) (ad
 	return "ws:" + s.URL[5:]
 }
 
+// makeUpgradeServer starts a remote server which accepts any origin, and
+// runs the handler with each connection and the request it was upgraded
+// from.
+func (e *EndToEndSuite) makeUpgradeServer(handler func(c *websocket.Conn, r *http.Request)) (address string) {
+	t := e.T()
+	upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		require.Nil(t, err)
+		defer c.Close()
+
+		handler(c, r)
+	}))
+
+	e.servers = append(e.servers, s)
+
+	return "ws:" + s.URL[5:]
+}
+
+// makeHeaderServer starts a remote server which replies to a message with
+// the value of the header it was dialed with.
+func (e *EndToEndSuite) makeHeaderServer(name string) (address string) {
+	return e.makeUpgradeServer(func(c *websocket.Conn, r *http.Request) {
+		if _, _, err := c.ReadMessage(); err == nil {
+			c.WriteMessage(websocket.TextMessage, []byte(`"`+r.Header.Get(name)+`"`))
+		}
+	})
+}
+
+// memoryAccessLog is an AccessLogger which keeps records in memory.
+type memoryAccessLog struct {
+	mu          sync.Mutex
+	sessions    []SessionRecord
+	connections []ConnectionRecord
+}
+
+func (m *memoryAccessLog) LogSession(record SessionRecord) {
+	m.mu.Lock()
+	m.sessions = append(m.sessions, record)
+	m.mu.Unlock()
+}
+
+func (m *memoryAccessLog) LogConnection(record ConnectionRecord) {
+	m.mu.Lock()
+	m.connections = append(m.connections, record)
+	m.mu.Unlock()
+}
+
+func (m *memoryAccessLog) Connections() []ConnectionRecord {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ConnectionRecord(nil), m.connections...)
+}
+
 func echo(c *websocket.Conn) error {
 	mt, message, err := c.ReadMessage()
 	if err != nil {
@@ -126,6 +225,13 @@ func forever(fn func(conn *websocket.Conn) error) func(conn *websocket.Conn) err
 	}
 }
 
+// unresponsive reads the raw connection without handling any websocket
+// frames, such that pings go unanswered, until the connection is closed.
+func unresponsive(c *websocket.Conn) error {
+	ioutil.ReadAll(c.UnderlyingConn())
+	return nil
+}
+
 func yell(c *websocket.Conn) error {
 	mt, message, err := c.ReadMessage()
 	if err != nil {